@@ -0,0 +1,33 @@
+package common
+
+import "encoding/json"
+
+// Codec 节点之间传递 ReceiverLayerMessage 时使用的编码, 同一个部署中的所有节点必须使用相同的 Codec
+type Codec interface {
+	Name() string
+	Marshal(msg ReceiverLayerMessage) ([]byte, error)
+	Unmarshal(data []byte, msg *ReceiverLayerMessage) error
+}
+
+var (
+	// JSONCodec 原有的 JSON 格式, Data 会被 base64 编码
+	JSONCodec Codec = jsonCodec{}
+	// MsgPackCodec MessagePack 格式, 字段名与 JSON 相同, Data 使用 bin 类型
+	MsgPackCodec Codec = msgPackCodec{}
+	// ProtobufCodec 紧凑的长度前缀二进制格式, 与 protobuf 的 wire format 兼容
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(msg ReceiverLayerMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *ReceiverLayerMessage) error {
+	return json.Unmarshal(data, msg)
+}
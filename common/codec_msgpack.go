@@ -0,0 +1,402 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errMsgPack = errors.New("msgpack: invalid data")
+
+// msgPackCodec 只实现了 ReceiverLayerMessage 用到的 MessagePack 类型, 不依赖第三方库
+//
+//	{"message": {"message_type": int, "data": bin}, "channels": [str], "groups": [str], "seq": [uint]}
+//
+// 没有 seq 时省略这个 key, 与旧版本节点的格式一致
+type msgPackCodec struct{}
+
+func (msgPackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgPackCodec) Marshal(msg ReceiverLayerMessage) ([]byte, error) {
+	w := &msgPackWriter{buf: make([]byte, 0, 64+len(msg.Message.Data))}
+	if len(msg.Seq) > 0 {
+		w.mapHeader(4)
+	} else {
+		w.mapHeader(3)
+	}
+	w.str("message")
+	w.mapHeader(2)
+	w.str("message_type")
+	w.int(int64(msg.Message.MessageType))
+	w.str("data")
+	w.bin(msg.Message.Data)
+	w.str("channels")
+	w.strings(msg.Channels)
+	w.str("groups")
+	w.strings(msg.Groups)
+	if len(msg.Seq) > 0 {
+		w.str("seq")
+		w.header(0x90, 15, 0, 0xdc, 0xdd, len(msg.Seq))
+		for _, seq := range msg.Seq {
+			w.int(int64(seq))
+		}
+	}
+	return w.buf, nil
+}
+
+func (msgPackCodec) Unmarshal(data []byte, msg *ReceiverLayerMessage) error {
+	r := &msgPackReader{buf: data}
+	n, err := r.mapHeader()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		key, err := r.str()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "message":
+			err = r.message(&msg.Message)
+		case "channels":
+			msg.Channels, err = r.strings()
+		case "groups":
+			msg.Groups, err = r.strings()
+		case "seq":
+			msg.Seq, err = r.uints()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type msgPackWriter struct {
+	buf []byte
+}
+
+func (w *msgPackWriter) header(small byte, smallMax int, b8, b16, b32 byte, n int) {
+	switch {
+	case small != 0 && n <= smallMax:
+		w.buf = append(w.buf, small|byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		w.buf = append(w.buf, b8, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = append(w.buf, b16, 0, 0)
+		binary.BigEndian.PutUint16(w.buf[len(w.buf)-2:], uint16(n))
+	default:
+		w.buf = append(w.buf, b32, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], uint32(n))
+	}
+}
+
+func (w *msgPackWriter) mapHeader(n int) {
+	w.header(0x80, 15, 0, 0xde, 0xdf, n)
+}
+
+func (w *msgPackWriter) str(s string) {
+	w.header(0xa0, 31, 0xd9, 0xda, 0xdb, len(s))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgPackWriter) bin(b []byte) {
+	if b == nil {
+		w.buf = append(w.buf, 0xc0)
+		return
+	}
+	w.header(0, 0, 0xc4, 0xc5, 0xc6, len(b))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgPackWriter) strings(values []string) {
+	if values == nil {
+		w.buf = append(w.buf, 0xc0)
+		return
+	}
+	w.header(0x90, 15, 0, 0xdc, 0xdd, len(values))
+	for _, value := range values {
+		w.str(value)
+	}
+}
+
+func (w *msgPackWriter) int(n int64) {
+	switch {
+	case n >= 0 && n <= 127:
+		w.buf = append(w.buf, byte(n))
+	case n < 0 && n >= -32:
+		w.buf = append(w.buf, byte(n))
+	default:
+		w.buf = append(w.buf, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(w.buf[len(w.buf)-8:], uint64(n))
+	}
+}
+
+type msgPackReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *msgPackReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errMsgPack
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *msgPackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, errMsgPack
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgPackReader) uint(size int) (int, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (r *msgPackReader) isNil() bool {
+	if r.pos < len(r.buf) && r.buf[r.pos] == 0xc0 {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+func (r *msgPackReader) mapHeader() (int, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b&0xf0 == 0x80:
+		return int(b & 0x0f), nil
+	case b == 0xde:
+		return r.length(r.uint(2))
+	case b == 0xdf:
+		return r.length(r.uint(4))
+	}
+	return 0, errMsgPack
+}
+
+func (r *msgPackReader) arrayHeader() (int, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b&0xf0 == 0x90:
+		return int(b & 0x0f), nil
+	case b == 0xdc:
+		return r.length(r.uint(2))
+	case b == 0xdd:
+		return r.length(r.uint(4))
+	}
+	return 0, errMsgPack
+}
+
+// length 每个元素至少占一个字节, 超过剩余字节数的长度一定是错误的数据, 避免按它分配内存
+func (r *msgPackReader) length(n int, err error) (int, error) {
+	if err == nil && n > len(r.buf)-r.pos {
+		return 0, errMsgPack
+	}
+	return n, err
+}
+
+// raw 读取 str 或 bin
+func (r *msgPackReader) raw() ([]byte, error) {
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch {
+	case b&0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xd9 || b == 0xc4:
+		n, err = r.uint(1)
+	case b == 0xda || b == 0xc5:
+		n, err = r.uint(2)
+	case b == 0xdb || b == 0xc6:
+		n, err = r.uint(4)
+	default:
+		return nil, errMsgPack
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.next(n)
+}
+
+func (r *msgPackReader) str() (string, error) {
+	b, err := r.raw()
+	return string(b), err
+}
+
+func (r *msgPackReader) strings() ([]string, error) {
+	if r.isNil() {
+		return nil, nil
+	}
+	n, err := r.arrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := r.str()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func (r *msgPackReader) uints() ([]uint64, error) {
+	if r.isNil() {
+		return nil, nil
+	}
+	n, err := r.arrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, uint64(v))
+	}
+	return result, nil
+}
+
+func (r *msgPackReader) int() (int64, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	}
+	var size int
+	switch b {
+	case 0xcc, 0xd0:
+		size = 1
+	case 0xcd, 0xd1:
+		size = 2
+	case 0xce, 0xd2:
+		size = 4
+	case 0xcf, 0xd3:
+		size = 8
+	default:
+		return 0, errMsgPack
+	}
+	v, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range v {
+		u = u<<8 | uint64(c)
+	}
+	if b >= 0xd0 {
+		// 有符号整数按位宽做符号扩展
+		shift := uint(64 - size*8)
+		return int64(u<<shift) >> shift, nil
+	}
+	return int64(u), nil
+}
+
+func (r *msgPackReader) message(msg *Message) error {
+	n, err := r.mapHeader()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		key, err := r.str()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "message_type":
+			var v int64
+			v, err = r.int()
+			msg.MessageType = int(v)
+		case "data":
+			if r.isNil() {
+				msg.Data = nil
+				continue
+			}
+			var b []byte
+			b, err = r.raw()
+			msg.Data = append([]byte(nil), b...)
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip 跳过一个不认识的值, 用于兼容新增的字段
+func (r *msgPackReader) skip() error {
+	if r.pos >= len(r.buf) {
+		return errMsgPack
+	}
+	b := r.buf[r.pos]
+	switch {
+	case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+		r.pos++
+		return nil
+	case b&0xe0 == 0xa0 || (b >= 0xc4 && b <= 0xc6) || (b >= 0xd9 && b <= 0xdb):
+		_, err := r.raw()
+		return err
+	case b&0xf0 == 0x90 || b == 0xdc || b == 0xdd:
+		n, err := r.arrayHeader()
+		for i := 0; err == nil && i < n; i++ {
+			err = r.skip()
+		}
+		return err
+	case b&0xf0 == 0x80 || b == 0xde || b == 0xdf:
+		n, err := r.mapHeader()
+		for i := 0; err == nil && i < 2*n; i++ {
+			err = r.skip()
+		}
+		return err
+	case b >= 0xcc && b <= 0xd3:
+		_, err := r.int()
+		return err
+	case b == 0xca:
+		_, err := r.next(5)
+		return err
+	case b == 0xcb:
+		_, err := r.next(9)
+		return err
+	}
+	return errMsgPack
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errProtobuf = errors.New("protobuf: invalid data")
+
+// protobufCodec 手写的 protobuf wire format 编码, 对应的 schema:
+//
+//	message Message  { int64 message_type = 1; bytes data = 2; }
+//	message Envelope { Message message = 1; repeated string channels = 2; repeated string groups = 3; repeated uint64 seq = 4; }
+type protobufCodec struct{}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(msg ReceiverLayerMessage) ([]byte, error) {
+	inner := make([]byte, 0, 16+len(msg.Message.Data))
+	if msg.Message.MessageType != 0 {
+		inner = appendTag(inner, 1, wireVarint)
+		inner = appendUvarint(inner, uint64(msg.Message.MessageType))
+	}
+	if len(msg.Message.Data) > 0 {
+		inner = appendBytes(inner, 2, msg.Message.Data)
+	}
+
+	buf := make([]byte, 0, len(inner)+64)
+	buf = appendBytes(buf, 1, inner)
+	for _, channel := range msg.Channels {
+		buf = appendBytes(buf, 2, []byte(channel))
+	}
+	for _, group := range msg.Groups {
+		buf = appendBytes(buf, 3, []byte(group))
+	}
+	if len(msg.Seq) > 0 {
+		packed := make([]byte, 0, len(msg.Seq)*2)
+		for _, seq := range msg.Seq {
+			packed = appendUvarint(packed, seq)
+		}
+		buf = appendBytes(buf, 4, packed)
+	}
+	return buf, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg *ReceiverLayerMessage) error {
+	return protobufFields(data, func(field uint64, wire int, value []byte, n uint64) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			return protobufFields(value, func(field uint64, wire int, value []byte, n uint64) error {
+				switch {
+				case field == 1 && wire == wireVarint:
+					msg.Message.MessageType = int(int64(n))
+				case field == 2 && wire == wireBytes:
+					msg.Message.Data = append([]byte(nil), value...)
+				}
+				return nil
+			})
+		case field == 2 && wire == wireBytes:
+			msg.Channels = append(msg.Channels, string(value))
+		case field == 3 && wire == wireBytes:
+			msg.Groups = append(msg.Groups, string(value))
+		case field == 4 && wire == wireVarint:
+			msg.Seq = append(msg.Seq, n)
+		case field == 4 && wire == wireBytes:
+			// packed 编码
+			for len(value) > 0 {
+				seq, size := binary.Uvarint(value)
+				if size <= 0 {
+					return errProtobuf
+				}
+				msg.Seq = append(msg.Seq, seq)
+				value = value[size:]
+			}
+		}
+		return nil
+	})
+}
+
+// appendUvarint 等同于 go1.19 的 binary.AppendUvarint
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendTag(buf []byte, field uint64, wire int) []byte {
+	return appendUvarint(buf, field<<3|uint64(wire))
+}
+
+func appendBytes(buf []byte, field uint64, value []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// protobufFields 依次回调每个字段, varint 的值放在 n 中, 不认识的字段由回调忽略
+func protobufFields(data []byte, f func(field uint64, wire int, value []byte, n uint64) error) error {
+	for len(data) > 0 {
+		tag, size := binary.Uvarint(data)
+		if size <= 0 {
+			return errProtobuf
+		}
+		data = data[size:]
+		field, wire := tag>>3, int(tag&7)
+		var value []byte
+		var n uint64
+		switch wire {
+		case wireVarint:
+			n, size = binary.Uvarint(data)
+			if size <= 0 {
+				return errProtobuf
+			}
+		case wireFixed64:
+			size = 8
+		case wireFixed32:
+			size = 4
+		case wireBytes:
+			length, lengthSize := binary.Uvarint(data)
+			if lengthSize <= 0 || length > uint64(len(data)-lengthSize) {
+				return errProtobuf
+			}
+			value = data[lengthSize : lengthSize+int(length)]
+			size = lengthSize + int(length)
+		default:
+			return errProtobuf
+		}
+		if size > len(data) {
+			return errProtobuf
+		}
+		data = data[size:]
+		if err := f(field, wire, value, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
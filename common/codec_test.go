@@ -0,0 +1,75 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []ReceiverLayerMessage{
+		{},
+		{Message: Message{MessageType: 1, Data: []byte("hello")}, Channels: []string{"node!user"}},
+		{Message: Message{MessageType: 2, Data: []byte{0, 1, 0xc0, 0xff}}, Groups: []string{"a", "b"}},
+		{Message: Message{MessageType: 1, Data: []byte("seq")}, Groups: []string{"a", "b"}, Seq: []uint64{1, 1 << 40}},
+		{Message: Message{MessageType: -1, Data: make([]byte, 70000)}, Channels: make([]string, 20)},
+	}
+	for _, codec := range []Codec{JSONCodec, MsgPackCodec, ProtobufCodec} {
+		for i, msg := range messages {
+			data, err := codec.Marshal(msg)
+			if err != nil {
+				t.Fatalf("%s marshal %d: %v", codec.Name(), i, err)
+			}
+			var got ReceiverLayerMessage
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s unmarshal %d: %v", codec.Name(), i, err)
+			}
+			if !equalMessage(msg, got) {
+				t.Errorf("%s %d: got %+v, want %+v", codec.Name(), i, got, msg)
+			}
+		}
+	}
+}
+
+// 空的 slice 和 nil 视为相同, protobuf 无法区分两者
+func equalMessage(a, b ReceiverLayerMessage) bool {
+	return a.Message.MessageType == b.Message.MessageType &&
+		string(a.Message.Data) == string(b.Message.Data) &&
+		len(a.Channels) == len(b.Channels) && (len(a.Channels) == 0 || reflect.DeepEqual(a.Channels, b.Channels)) &&
+		len(a.Groups) == len(b.Groups) && (len(a.Groups) == 0 || reflect.DeepEqual(a.Groups, b.Groups)) &&
+		len(a.Seq) == len(b.Seq) && (len(a.Seq) == 0 || reflect.DeepEqual(a.Seq, b.Seq))
+}
+
+// JSONCodec 必须与旧版本节点直接使用 encoding/json 的格式一致
+func TestJSONCodecCompatible(t *testing.T) {
+	msg := ReceiverLayerMessage{Message: Message{MessageType: 1, Data: []byte("hi")}, Groups: []string{"room"}}
+	want, _ := json.Marshal(msg)
+	got, _ := JSONCodec.Marshal(msg)
+	if string(got) != string(want) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestCodecInvalid(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, MsgPackCodec, ProtobufCodec} {
+		data, _ := codec.Marshal(ReceiverLayerMessage{Message: Message{Data: []byte("truncated")}})
+		var msg ReceiverLayerMessage
+		if err := codec.Unmarshal(data[:len(data)-3], &msg); err == nil {
+			t.Errorf("%s: expected error for truncated data", codec.Name())
+		}
+	}
+}
+
+// TestMsgPackOversizedLength 头部声明的长度超过数据时返回错误, 不按声明的长度分配内存
+func TestMsgPackOversizedLength(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x81, 0xa6, 'g', 'r', 'o', 'u', 'p', 's', 0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xa8, 'c', 'h', 'a', 'n', 'n', 'e', 'l', 's', 0xdc, 0xff, 0xff, 0xa1, 'a'},
+		{0xdf, 0xff, 0xff, 0xff, 0xff},
+	} {
+		var msg ReceiverLayerMessage
+		if err := MsgPackCodec.Unmarshal(data, &msg); err == nil {
+			t.Errorf("%x: expected error, got %+v", data, msg)
+		}
+	}
+}
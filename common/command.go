@@ -0,0 +1,39 @@
+package common
+
+import "encoding/json"
+
+// CommandMessageType 节点之间传递控制命令的 MessageType, 这类消息由目标节点执行, 不会发给客户端
+const CommandMessageType = -1
+
+// 控制命令
+const (
+	CommandClose        = "close"         // 断开连接
+	CommandLeave        = "leave"         // 强制离开 Groups
+	CommandRefreshAuth  = "refresh_auth"  // 重新校验连接的权限
+	CommandGroupAdd     = "group_add"     // 在 channel 所在节点记录加入的 Groups
+	CommandGroupDiscard = "group_discard" // 在 channel 所在节点移除 Groups
+)
+
+// Command 和普通消息一样通过 Send 或 GroupSend 路由到 channel 所在的节点
+type Command struct {
+	Action string   `json:"action"`
+	Code   int      `json:"code,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Data   []byte   `json:"data,omitempty"`
+}
+
+func CommandMessage(command Command) (Message, error) {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{MessageType: CommandMessageType, Data: data}, nil
+}
+
+// ParseCommand 解析 CommandMessageType 消息中的命令
+func ParseCommand(message Message) (Command, error) {
+	var command Command
+	err := json.Unmarshal(message.Data, &command)
+	return command, err
+}
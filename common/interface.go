@@ -1,6 +1,9 @@
 package common
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type LayerInterface interface {
 	GroupAdd(channel string, groups ...string) error
@@ -8,6 +11,24 @@ type LayerInterface interface {
 	GroupSend(message Message, groups ...string) error
 	Send(message Message, channels ...string) error
 	GetChannels(group string) ([]string, error)
+	// GroupHistory 返回 group 中序号大于 since 的历史消息, 按序号升序; 没有开启历史时返回空
+	GroupHistory(group string, since uint64) ([]HistoryMessage, error)
+	// UserAdd 记录用户的一个 channel, 同一个用户可以有多个 channel(多设备)
+	UserAdd(user string, channel string) error
+	UserDiscard(user string, channel string) error
+	GetUserChannels(user string) ([]string, error)
+	// PresenceAdd 记录 channel 在 group 中在线, 相同 channel 再次加入会覆盖原来的信息
+	PresenceAdd(group string, info PresenceInfo) error
+	PresenceDiscard(group string, channel string) error
+	Presence(group string) ([]PresenceInfo, error)
+	// OfflinePush 缓存发给离线 channel 的消息, 丢弃并返回超过 maxLen 的最早的消息以及已经超过 ttl 的消息
+	OfflinePush(channel string, message Message, maxLen int, ttl time.Duration) ([]Message, error)
+	// OfflineDrain 取出并清空 channel 缓存的消息, 按发送顺序返回, 超过 ttl 的消息放在 expired 中
+	OfflineDrain(channel string, ttl time.Duration) (messages []Message, expired []Message, err error)
 	NewChannel(user string) string
+	// Nodes 返回当前存活的节点
+	Nodes() ([]string, error)
 	Run(ctx context.Context) error
+	// Wait 等待 Run 启动的任务在 ctx 结束后全部退出
+	Wait()
 }
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 type Message struct {
 	MessageType int    `json:"message_type"`
 	Data        []byte `json:"data"`
@@ -8,5 +10,14 @@ type Message struct {
 type ReceiverLayerMessage struct {
 	Message  Message  `json:"message"` //  Message struct
 	Channels []string `json:"channels"`
-	Groups   []string `json:"groups"` // todo
+	Groups   []string `json:"groups"`        // 由接收节点按本地的 group 成员展开
+	Seq      []uint64 `json:"seq,omitempty"` // 与 Groups 一一对应, group 开启历史时为消息在其中的序号
+	Ack      func()   `json:"-"`             // 不为 nil 时需要在消息交给客户端后调用
+}
+
+// HistoryMessage group 的历史消息, Seq 在同一个 group 内从 1 开始递增
+type HistoryMessage struct {
+	Seq     uint64
+	Time    time.Time
+	Message Message
 }
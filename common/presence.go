@@ -0,0 +1,37 @@
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PresenceInfo group 中一个在线连接的信息
+type PresenceInfo struct {
+	Channel  string            `json:"channel"`
+	User     string            `json:"user,omitempty"`
+	JoinedAt time.Time         `json:"joined_at"`
+	Meta     map[string]string `json:"meta,omitempty"`
+}
+
+// presence 事件的类型
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// PresenceEvent 加入或离开 group 时广播给 group 的消息
+type PresenceEvent struct {
+	Type  string `json:"type"`
+	Group string `json:"group"`
+	PresenceInfo
+}
+
+// PresenceMessage 把事件编码为发给 group 的文本消息
+func PresenceMessage(event PresenceEvent) (Message, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return Message{}, err
+	}
+	// 1 即 websocket.TextMessage
+	return Message{MessageType: 1, Data: data}, nil
+}
@@ -1,6 +1,14 @@
 package common
 
-import "math/rand"
+import (
+	"math/rand"
+	"time"
+)
+
+func init() {
+	// 节点名称和 channel 都依赖 RandomString, 不设置种子时每个进程生成的序列相同
+	rand.Seed(time.Now().UnixNano())
+}
 
 func RandomString(n int) string {
 	var defaultLetters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -1,18 +1,54 @@
 package config
 
-import "time"
+import (
+	"time"
+	"ws-channels/logger"
+	"ws-channels/metrics"
+)
 
 type LayerEnum int
 
 const (
-	RedisLayer LayerEnum = 1
+	RedisLayer  LayerEnum = 1
+	MemoryLayer LayerEnum = 2
 )
 
 type Config struct {
 	Layer       LayerEnum
 	RedisConfig *RedisConfig
+	// Codec 节点之间传递消息的编码, 同一个部署中的所有节点必须相同
+	Codec CodecEnum
+	// HistorySize 每个 group 保留的最近消息数, HistoryTTL 保留的时长, 都为 0 时不保留历史
+	HistorySize int
+	HistoryTTL  time.Duration
+	// Logger 服务端和 layer 使用的日志, 为 nil 时使用 logger.Default
+	Logger logger.Logger
+	// Metrics 服务端和 layer 使用的指标收集, 为 nil 时不收集; 为 *metrics.Registry 时导出前会采样队列长度
+	Metrics metrics.Collector
+	// AllowedOrigins 允许连接的浏览器来源, 例如 "https://example.com", "*" 允许所有来源; 为空时只允许同源
+	AllowedOrigins []string
+	// AuthSecret 不为空时使用这个密钥校验 HMAC 签名的令牌
+	AuthSecret string
 }
 
+// CodecEnum 节点之间传递消息的编码
+type CodecEnum int
+
+const (
+	JSONCodec     CodecEnum = 0 // 原有的 JSON 格式, 兼容旧版本节点
+	MsgPackCodec  CodecEnum = 1 // MessagePack, Data 不需要 base64
+	ProtobufCodec CodecEnum = 2 // 长度前缀的二进制格式, 体积最小
+)
+
+// RedisTransport redis layer 节点之间投递消息的方式
+type RedisTransport int
+
+const (
+	RedisListTransport   RedisTransport = 0 // LPUSH/BRPOP 每个节点一个 list
+	RedisPubSubTransport RedisTransport = 1 // PUBLISH/SUBSCRIBE 每个节点和每个 group 一个频道
+	RedisStreamTransport RedisTransport = 2 // XADD/XREADGROUP 每个节点一个 stream, 至少投递一次
+)
+
 type RedisConfig struct {
 	Addr        string
 	Password    string
@@ -21,4 +57,23 @@ type RedisConfig struct {
 	MaxIdle     int
 	IdleTimeout time.Duration
 	Wait        bool
+	Transport   RedisTransport
+	// NodeName 节点名称, 为空时随机生成; stream 模式下重启使用相同的名称才能重新投递未确认的消息
+	NodeName string
+	// StreamMaxLen stream 模式下每个节点 stream 的最大长度, 为 0 时不限制
+	StreamMaxLen int64
+	// SentinelAddrs 不为空时通过 sentinel 发现 SentinelMaster 的主节点并跟随故障转移, 忽略 Addr
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+	// ClusterAddrs 不为空时使用 Redis Cluster 模式, 这些地址只用于发现集群节点, 忽略 Addr 和 DB
+	ClusterAddrs []string
+	// NodeLease 节点租约的时长, 为 0 时使用默认值; 超过租约没有续约的节点会被清理
+	NodeLease time.Duration
+	// Shards 不为空时把 group、用户和节点的数据按一致性哈希分布到这些 redis 上, 忽略 Addr;
+	// 每个分片只使用 Addr、Password、DB 和 Sentinel 的配置, 连接池的参数使用外层的配置.
+	// 注意没有分布的部分: pub/sub (包括 RedisPubSubTransport 的全部消息) 只使用第一个分片,
+	// 节点列表 nodes 是一个 zset, 只保存在它哈希到的那个分片上; 这两个分片不可用时跨节点投递、
+	// 节点续约和失效节点的清理都会停止, 是单点故障, 生产环境应该为它们配置 Sentinel
+	Shards []*RedisConfig
 }
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CloseTokenExpired 令牌过期时断开连接使用的 code
+const CloseTokenExpired = 4004
+
+var (
+	ErrMissingToken = errors.New("missing token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Claims 令牌中的信息, 认证通过后保存在 Client 上
+type Claims struct {
+	// Subject 用户, 没有 OnConnect 时作为 next 的 channel 名称
+	Subject string `json:"sub,omitempty"`
+	// ExpiresAt 过期时间的 unix 秒数, 为 0 时不过期; 到期后连接以 CloseTokenExpired 断开
+	ExpiresAt int64             `json:"exp,omitempty"`
+	Extra     map[string]string `json:"ext,omitempty"`
+
+	// protocol 通过 Sec-WebSocket-Protocol 携带令牌时握手响应需要返回的协议名
+	protocol string
+}
+
+// Expires 过期时间, 不过期时为零值
+func (c *Claims) Expires() time.Time {
+	if c.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Authenticator 在升级为 websocket 之前校验请求, 返回错误时以 401 拒绝连接
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Claims, error)
+}
+
+// HMACAuthenticator 校验 HMAC-SHA256 签名的令牌, 格式为 base64url(claims JSON) + "." + base64url(签名);
+// 令牌依次从查询参数、请求头和 Sec-WebSocket-Protocol 中读取
+type HMACAuthenticator struct {
+	Secret []byte
+	// QueryParam 携带令牌的查询参数, 为空时不读取
+	QueryParam string
+	// Header 携带令牌的请求头, 可以有 "Bearer " 前缀, 为空时不读取
+	Header string
+	// Protocol 浏览器不能设置请求头时, 在 Sec-WebSocket-Protocol 中依次传入 Protocol 和令牌, 为空时不读取
+	Protocol string
+}
+
+func NewHMACAuthenticator(secret []byte) *HMACAuthenticator {
+	return &HMACAuthenticator{
+		Secret:     secret,
+		QueryParam: "token",
+		Header:     "Authorization",
+		Protocol:   "access_token",
+	}
+}
+
+// Sign 生成令牌
+func (a *HMACAuthenticator) Sign(claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.signature(encoded)), nil
+}
+
+// Verify 校验签名和过期时间
+func (a *HMACAuthenticator) Verify(token string) (*Claims, error) {
+	position := strings.IndexByte(token, '.')
+	if position < 0 {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[position+1:])
+	if err != nil || !hmac.Equal(signature, a.signature(token[:position])) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:position])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.ExpiresAt != 0 && !time.Now().Before(claims.Expires()) {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func (a *HMACAuthenticator) signature(payload string) []byte {
+	mac := hmac.New(sha256.New, a.Secret)
+	_, _ = mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (a *HMACAuthenticator) Authenticate(req *http.Request) (*Claims, error) {
+	if a.QueryParam != "" {
+		if token := req.URL.Query().Get(a.QueryParam); token != "" {
+			return a.Verify(token)
+		}
+	}
+	if a.Header != "" {
+		if token := req.Header.Get(a.Header); token != "" {
+			if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+				token = token[7:]
+			}
+			return a.Verify(token)
+		}
+	}
+	if a.Protocol != "" {
+		protocols := websocket.Subprotocols(req)
+		for i := 0; i+1 < len(protocols); i++ {
+			if protocols[i] == a.Protocol {
+				claims, err := a.Verify(protocols[i+1])
+				if err == nil {
+					claims.protocol = a.Protocol
+				}
+				return claims, err
+			}
+		}
+	}
+	return nil, ErrMissingToken
+}
+
+// AllowOrigins 返回只允许这些来源的 CheckOrigin, 例如 "https://example.com"; "*" 允许所有来源,
+// "https://*.example.com" 允许所有子域名; 没有 Origin 请求头的非浏览器客户端总是允许
+func AllowOrigins(origins ...string) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		for _, allowed := range origins {
+			if matchOrigin(allowed, u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchOrigin(allowed string, origin *url.URL) bool {
+	if allowed == "*" {
+		return true
+	}
+	pattern, err := url.Parse(allowed)
+	if err != nil || !strings.EqualFold(pattern.Scheme, origin.Scheme) {
+		return false
+	}
+	host := strings.ToLower(origin.Host)
+	patternHost := strings.ToLower(pattern.Host)
+	if strings.HasPrefix(patternHost, "*.") {
+		return strings.HasSuffix(host, patternHost[1:])
+	}
+	return host == patternHost
+}
+
+// authenticate 认证失败时写入 401 响应并返回 false
+func (s *Server) authenticate(resp http.ResponseWriter, req *http.Request, client *Client) bool {
+	if s.Authenticator == nil {
+		return true
+	}
+	claims, err := s.Authenticator.Authenticate(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	client.claims = claims
+	return true
+}
+
+// upgradeHeader 通过 Sec-WebSocket-Protocol 携带令牌时在握手响应中返回协议名
+func (c *Client) upgradeHeader() http.Header {
+	claims := c.Claims()
+	if claims == nil || claims.protocol == "" {
+		return nil
+	}
+	return http.Header{"Sec-Websocket-Protocol": []string{claims.protocol}}
+}
+
+// Claims 认证通过的令牌信息, 没有认证时为 nil
+func (c *Client) Claims() *Claims {
+	c.claimsMu.Lock()
+	defer c.claimsMu.Unlock()
+	return c.claims
+}
+
+// SetClaims 替换令牌信息并按新的过期时间重新计时, 例如在 OnRefreshAuth 中校验新的令牌后调用
+func (c *Client) SetClaims(claims *Claims) {
+	c.claimsMu.Lock()
+	c.claims = claims
+	c.claimsMu.Unlock()
+	c.watchExpiry()
+}
+
+// watchExpiry 令牌到期时断开连接
+func (c *Client) watchExpiry() {
+	c.claimsMu.Lock()
+	defer c.claimsMu.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	// 升级完成之前设置的令牌在注册之后开始计时
+	if c.claims == nil || c.claims.ExpiresAt == 0 || c.wsSocket == nil || c.ctx.Err() != nil {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(c.claims.Expires()), func() {
+		c.disconnect(CloseTokenExpired, ErrTokenExpired.Error())
+	})
+}
+
+func (c *Client) stopExpiry() {
+	c.claimsMu.Lock()
+	defer c.claimsMu.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+	"ws-channels/common"
+	"ws-channels/metrics"
+)
+
+// SendPolicy 客户端发送队列已满时的处理方式
+type SendPolicy int32
+
+const (
+	SendBlock      SendPolicy = 0 // 阻塞等待, 超过 SendTimeout 后丢弃这条消息; 等待期间阻塞调用方, 包括 layer 消息的分发
+	SendDropNewest SendPolicy = 1 // 丢弃这条新消息
+	SendDropOldest SendPolicy = 2 // 丢弃队列中最早的消息
+	SendDisconnect SendPolicy = 3 // 丢弃这条消息并断开客户端
+
+	sendPolicyInherit SendPolicy = -1
+)
+
+// CloseSlowConsumer 因为发送队列已满被断开时 OnDisconnect 收到的 code
+const CloseSlowConsumer = 4001
+
+const (
+	DefaultSendQueueSize = 1000
+	DefaultSendTimeout   = 5 * time.Second
+)
+
+var (
+	ErrMessageDropped = errors.New("send queue full, message dropped")
+	ErrClientClosed   = errors.New("client closed")
+)
+
+// SetSendPolicy 覆盖服务端的发送策略, timeout 只对 SendBlock 生效, 为 0 时一直阻塞
+func (c *Client) SetSendPolicy(policy SendPolicy, timeout time.Duration) {
+	atomic.StoreInt64(&c.sendTimeout, int64(timeout))
+	atomic.StoreInt32(&c.sendPolicy, int32(policy))
+}
+
+func (c *Client) policy() (SendPolicy, time.Duration) {
+	if policy := SendPolicy(atomic.LoadInt32(&c.sendPolicy)); policy != sendPolicyInherit {
+		return policy, time.Duration(atomic.LoadInt64(&c.sendTimeout))
+	}
+	return c.server.SendPolicy, c.server.SendTimeout
+}
+
+// Dropped 这个客户端因为发送队列已满丢弃的消息数
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *Client) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+	atomic.AddUint64(&c.server.dropped, 1)
+	c.server.collector().Add(metrics.MessagesDroppedTotal, 1)
+}
+
+// Dropped 所有客户端因为发送队列已满丢弃的消息总数
+func (s *Server) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// enqueue 把消息放入发送队列, 队列已满时按发送策略处理
+func (c *Client) enqueue(msg common.Message) error {
+	if c.ctx.Err() != nil {
+		return ErrClientClosed
+	}
+	select {
+	case c.outChan <- msg:
+		return nil
+	default:
+	}
+
+	policy, timeout := c.policy()
+	switch policy {
+	case SendDropNewest:
+		c.drop()
+		return ErrMessageDropped
+	case SendDropOldest:
+		for {
+			select {
+			case c.outChan <- msg:
+				return nil
+			default:
+			}
+			select {
+			case <-c.outChan:
+				c.drop()
+			default:
+			}
+		}
+	case SendDisconnect:
+		c.drop()
+		go c.disconnect(CloseSlowConsumer, "send queue full")
+		return ErrMessageDropped
+	default:
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case c.outChan <- msg:
+			return nil
+		case <-c.ctx.Done():
+			return ErrClientClosed
+		case <-expired:
+			c.drop()
+			return ErrMessageDropped
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"ws-channels/common"
+)
+
+// DuplicatePolicy 同一个节点上第二个连接使用相同 channel 名称时的处理方式
+type DuplicatePolicy int
+
+const (
+	DuplicateKick   DuplicatePolicy = 0 // 断开旧连接, 新连接接管这个 channel
+	DuplicateReject DuplicatePolicy = 1 // 拒绝新连接
+	DuplicateMulti  DuplicatePolicy = 2 // 允许同一用户多个设备同时在线, 每个连接使用 节点!用户!设备 格式的 channel
+)
+
+const (
+	// CloseReplaced 被相同名称的新连接挤掉时 OnDisconnect 收到的 code
+	CloseReplaced = 4002
+	// CloseChannelTaken 升级之后才发现名称已被占用时发给新连接的 code
+	CloseChannelTaken = 4003
+)
+
+var (
+	ErrInvalidChannelName = errors.New("channel name must not contain '!'")
+	ErrChannelTaken       = errors.New("channel name already in use")
+)
+
+// nodeName channel 所在的节点, 即第一个 '!' 之前的部分
+func nodeName(channel string) string {
+	if position := strings.Index(channel, "!"); position > -1 {
+		return channel[:position]
+	}
+	return channel
+}
+
+// isLocal channel 是否属于本节点, 本节点的名称在第一次调用时确定, 之后不能再替换 Layer
+func (s *Server) isLocal(channel string) bool {
+	s.nodeOnce.Do(func() {
+		s.node = nodeName(s.Layer.NewChannel(""))
+	})
+	return nodeName(channel) == s.node
+}
+
+// channelName 按 DuplicatePolicy 为 next(name) 生成 channel, name 为空时随机生成
+func (s *Server) channelName(name string) (string, error) {
+	if name == "" {
+		return s.Layer.NewChannel(""), nil
+	}
+	if strings.Contains(name, "!") {
+		return "", ErrInvalidChannelName
+	}
+	switch s.DuplicatePolicy {
+	case DuplicateMulti:
+		return s.Layer.NewChannel(name + "!" + common.RandomString(8)), nil
+	case DuplicateReject:
+		channel := s.Layer.NewChannel(name)
+		if _, ok := s.Clients.Get(channel); ok {
+			return "", ErrChannelTaken
+		}
+		return channel, nil
+	default:
+		return s.Layer.NewChannel(name), nil
+	}
+}
+
+// register 把已升级的客户端加入注册表, 名称冲突时按 DuplicatePolicy 处理
+func (s *Server) register(client *Client) error {
+	if s.DuplicatePolicy == DuplicateReject {
+		if !s.Clients.AddIfAbsent(client) {
+			client.disconnect(CloseChannelTaken, ErrChannelTaken.Error())
+			return ErrChannelTaken
+		}
+		return nil
+	}
+	if old := s.Clients.Add(client); old != nil && old != client {
+		// 同步断开, 保证旧连接的 OnDisconnect 在新连接的 OnConnect 继续执行之前完成
+		old.disconnect(CloseReplaced, "replaced by a new connection")
+	}
+	return nil
+}
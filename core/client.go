@@ -3,66 +3,220 @@ package core
 import (
 	"context"
 	"github.com/gorilla/websocket"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 	"ws-channels/common"
+	"ws-channels/metrics"
 )
 
 type Client struct {
+	// 原子操作的 64 位字段放在最前面以保证对齐
+	dropped     uint64
+	sendTimeout int64
+
 	Channel string
-	Req     *http.Request
-
-	isClose  bool
-	cancel   context.CancelFunc
-	inChan   chan string
-	outChan  chan common.Message
-	wsSocket *websocket.Conn
-	server   *Server
+	// User next 传入的名称, 随机生成 channel 的连接为空
+	User string
+	Req  *http.Request
+
+	sendPolicy int32
+	closeOnce  sync.Once
+	drainOnce  sync.Once
+	drain      chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	outChan    chan common.Message
+	wsSocket   *websocket.Conn
+	server     *Server
+
+	presenceMu sync.Mutex
+	presence   map[string]common.PresenceInfo
+
+	valuesMu sync.RWMutex
+	values   map[string]interface{}
+
+	claimsMu sync.Mutex
+	claims   *Claims
+	expiry   *time.Timer
+
+	messageBucket tokenBucket
+	publishBucket tokenBucket
+
+	// holding 补发离线消息期间暂存实时消息, 补发完成后按顺序交给 OnMessage
+	holdMu  sync.Mutex
+	holding bool
+	held    []common.Message
+}
+
+// Set 在连接上保存一个值, 中间件可以用来传递认证结果等信息
+func (c *Client) Set(key string, value interface{}) {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+}
+
+// Get 返回 Set 保存的值
+func (c *Client) Get(key string) (interface{}, bool) {
+	c.valuesMu.RLock()
+	defer c.valuesMu.RUnlock()
+	value, ok := c.values[key]
+	return value, ok
 }
 
 func (c *Client) readLoop(ctx context.Context) {
+	if pongWait := c.server.PongWait; pongWait > 0 {
+		_ = c.wsSocket.SetReadDeadline(time.Now().Add(pongWait))
+		c.wsSocket.SetPongHandler(func(string) error {
+			return c.wsSocket.SetReadDeadline(time.Now().Add(pongWait))
+		})
+	}
 	for {
-		select {
-		case <-ctx.Done():
+		messageType, data, err := c.wsSocket.ReadMessage()
+		if err != nil {
+			c.finish(closeCode(err), err.Error())
 			return
-		default:
-			if messageType, data, err := c.wsSocket.ReadMessage(); err != nil {
-				c.Close(websocket.CloseNormalClosure, err.Error())
-			} else if c.server.OnMessage != nil {
-				c.server.OnMessage(messageType, data, FromLocal, c)
+		}
+		c.server.collector().Add(metrics.MessagesReceivedTotal, 1)
+		// 被限制的消息也说明连接还活着, 先刷新读超时
+		if pongWait := c.server.PongWait; pongWait > 0 {
+			_ = c.wsSocket.SetReadDeadline(time.Now().Add(pongWait))
+		}
+		if !c.allowMessage() {
+			if ctx.Err() != nil {
+				return
 			}
+			continue
+		}
+		if c.server.ControlProtocol && c.server.handleControl(messageType, data, c) {
+			continue
+		}
+		c.server.message(messageType, data, FromLocal, c)
+		if ctx.Err() != nil {
+			return
 		}
-
 	}
-
 }
 
-func (c Client) writeLoop(ctx context.Context) {
+func (c *Client) writeLoop(ctx context.Context) {
+	var ping <-chan time.Time
+	if c.server.PingInterval > 0 {
+		ticker := time.NewTicker(c.server.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
 	for {
 		select {
 		case msg := <-c.outChan:
+			_ = c.wsSocket.SetWriteDeadline(c.writeDeadline())
 			if err := c.wsSocket.WriteMessage(msg.MessageType, msg.Data); err != nil {
-				c.Close(websocket.CloseNormalClosure, err.Error())
+				c.finish(closeCode(err), err.Error())
+				return
 			}
+			c.server.collector().Add(metrics.MessagesSentTotal, 1)
+		case <-ping:
+			if err := c.wsSocket.WriteControl(websocket.PingMessage, nil, c.writeDeadline()); err != nil {
+				c.finish(closeCode(err), err.Error())
+				return
+			}
+		case <-c.drain:
+			c.flush()
+			c.disconnect(websocket.CloseGoingAway, "server shutdown")
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (c Client) Send(messageType int, data []byte) {
-	c.outChan <- common.Message{
+// flush 发送队列中剩余的消息
+func (c *Client) flush() {
+	for {
+		select {
+		case msg := <-c.outChan:
+			_ = c.wsSocket.SetWriteDeadline(c.writeDeadline())
+			if err := c.wsSocket.WriteMessage(msg.MessageType, msg.Data); err != nil {
+				return
+			}
+			c.server.collector().Add(metrics.MessagesSentTotal, 1)
+		default:
+			return
+		}
+	}
+}
+
+// goAway 让 writeLoop 发送完队列中的消息后以 CloseGoingAway 断开连接
+func (c *Client) goAway() {
+	c.drainOnce.Do(func() {
+		close(c.drain)
+	})
+}
+
+// writeDeadline 零值表示不限制
+func (c *Client) writeDeadline() time.Time {
+	if c.server.WriteWait > 0 {
+		return time.Now().Add(c.server.WriteWait)
+	}
+	return time.Time{}
+}
+
+// closeCode 读写出错时传给 OnDisconnect 的 code, 超时使用 CloseHeartbeatTimeout
+func closeCode(err error) int {
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		return closeErr.Code
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return CloseHeartbeatTimeout
+	}
+	return websocket.CloseAbnormalClosure
+}
+
+// finish 释放连接资源并触发 OnDisconnect, 只会执行一次
+func (c *Client) finish(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.stopExpiry()
+		_ = c.wsSocket.Close()
+		if c.server.Clients.Remove(c) && c.User != "" {
+			if err := c.server.Layer.UserDiscard(c.User, c.Channel); err != nil {
+				c.server.log().Warn("user discard failed", "channel", c.Channel, "user", c.User, "error", err)
+			}
+			c.server.goOffline(c)
+		}
+		c.leaveAll()
+		c.server.collector().Add(metrics.DisconnectionsTotal, 1)
+		c.server.disconnect(code, reason, c)
+	})
+}
+
+// Send 把消息放入发送队列, 队列已满时按 SendPolicy 处理
+func (c *Client) Send(messageType int, data []byte) error {
+	return c.enqueue(common.Message{
 		MessageType: messageType,
 		Data:        data,
-	}
+	})
 }
 
-func (c Client) GroupAdd(groups ...string) error {
+// disconnect 发送 close 帧后直接释放连接, 不等待对方回应
+func (c *Client) disconnect(code int, reason string) {
+	_ = c.wsSocket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), c.writeDeadline())
+	c.finish(code, reason)
+}
+
+func (c *Client) GroupAdd(groups ...string) error {
 	return c.server.GroupAdd(c.Channel, groups...)
 }
 
-func (c Client) GroupDiscard(groups ...string) error {
+func (c *Client) GroupDiscard(groups ...string) error {
 	return c.server.GroupDiscard(c.Channel, groups...)
 }
-func (c Client) GroupSend(messageType int, data []byte, groups ...string, ) error {
+func (c *Client) GroupSend(messageType int, data []byte, groups ...string) error {
+	if err := c.allowPublish(); err != nil {
+		return err
+	}
 	return c.server.GroupSend(messageType, data, groups...)
 }
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+	"ws-channels/common"
+	"ws-channels/config"
+)
+
+// newQueueClient 没有连接的客户端, 发送队列不会被消费
+func newQueueClient(server *Server, size int) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		sendPolicy: int32(sendPolicyInherit),
+		ctx:        ctx,
+		cancel:     cancel,
+		outChan:    make(chan common.Message, size),
+		server:     server,
+	}
+}
+
+func queued(c *Client) []string {
+	result := make([]string, 0)
+	for len(c.outChan) > 0 {
+		result = append(result, string((<-c.outChan).Data))
+	}
+	return result
+}
+
+func TestSendPolicy(t *testing.T) {
+	server := &Server{SendPolicy: SendDropNewest}
+	c := newQueueClient(server, 2)
+	for _, data := range []string{"1", "2", "3"} {
+		_ = c.Send(1, []byte(data))
+	}
+	if got := queued(c); len(got) != 2 || got[1] != "2" || c.Dropped() != 1 {
+		t.Errorf("drop newest: %v, dropped %d", got, c.Dropped())
+	}
+
+	c.SetSendPolicy(SendDropOldest, 0)
+	for _, data := range []string{"1", "2", "3"} {
+		_ = c.Send(1, []byte(data))
+	}
+	if got := queued(c); len(got) != 2 || got[0] != "2" || got[1] != "3" || c.Dropped() != 2 {
+		t.Errorf("drop oldest: %v, dropped %d", got, c.Dropped())
+	}
+
+	c.SetSendPolicy(SendBlock, 50*time.Millisecond)
+	_ = c.Send(1, []byte("1"))
+	_ = c.Send(1, []byte("2"))
+	start := time.Now()
+	if err := c.Send(1, []byte("3")); err != ErrMessageDropped || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("block with timeout: %v after %v", err, time.Since(start))
+	}
+	if server.Dropped() != 3 {
+		t.Errorf("server dropped %d, want 3", server.Dropped())
+	}
+
+	c.cancel()
+	if err := c.Send(1, []byte("closed")); err != ErrClientClosed {
+		t.Errorf("send after close: %v", err)
+	}
+}
+
+// TestDefaultSendPolicy 默认策略不阻塞发送方, 慢客户端不会拖住 layer 消息的分发
+func TestDefaultSendPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(&config.Config{Layer: config.MemoryLayer}, ctx, nil, nil, nil)
+	c := newQueueClient(server, 1)
+	start := time.Now()
+	_ = c.Send(1, []byte("1"))
+	_ = c.Send(1, []byte("2"))
+	if time.Since(start) >= DefaultSendTimeout {
+		t.Errorf("send blocked for %v", time.Since(start))
+	}
+	if got := queued(c); len(got) != 1 || got[0] != "2" || c.Dropped() != 1 {
+		t.Errorf("default policy: %v, dropped %d", got, c.Dropped())
+	}
+}
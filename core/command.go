@@ -0,0 +1,98 @@
+package core
+
+import (
+	"github.com/gorilla/websocket"
+	"ws-channels/common"
+)
+
+// CloseAuthFailed OnRefreshAuth 返回错误时断开连接使用的 code
+const CloseAuthFailed = websocket.ClosePolicyViolation
+
+func (s *Server) sendCommand(command common.Command, channels ...string) error {
+	message, err := common.CommandMessage(command)
+	if err != nil {
+		return err
+	}
+	return s.Layer.Send(message, channels...)
+}
+
+func (s *Server) groupCommand(command common.Command, groups ...string) error {
+	message, err := common.CommandMessage(command)
+	if err != nil {
+		return err
+	}
+	return s.Layer.GroupSend(message, groups...)
+}
+
+// CloseChannel 断开 channel 对应的连接, 连接可以在任何节点上
+func (s *Server) CloseChannel(code int, reason string, channels ...string) error {
+	return s.sendCommand(common.Command{Action: common.CommandClose, Code: code, Reason: reason}, channels...)
+}
+
+// CloseGroup 断开 group 中所有节点上的连接
+func (s *Server) CloseGroup(code int, reason string, groups ...string) error {
+	return s.groupCommand(common.Command{Action: common.CommandClose, Code: code, Reason: reason}, groups...)
+}
+
+// ForceLeave 让 channel 离开这些 group, 通过 Join 加入的会广播 leave 事件
+func (s *Server) ForceLeave(channel string, groups ...string) error {
+	return s.sendCommand(common.Command{Action: common.CommandLeave, Groups: groups}, channel)
+}
+
+// RefreshAuth 让连接所在的节点调用 OnRefreshAuth 重新校验权限, data 原样传给 OnRefreshAuth
+func (s *Server) RefreshAuth(data []byte, channels ...string) error {
+	return s.sendCommand(common.Command{Action: common.CommandRefreshAuth, Data: data}, channels...)
+}
+
+// handleCommand 在本节点的目标连接上执行命令, 每个连接单独执行以免阻塞消息接收
+func (s *Server) handleCommand(msg common.ReceiverLayerMessage) {
+	command, err := common.ParseCommand(msg.Message)
+	if err != nil {
+		s.log().Warn("invalid command", "error", err)
+		return
+	}
+	// 成员变化与之后的 group 消息按顺序处理, 也不需要连接在线
+	switch command.Action {
+	case common.CommandGroupAdd:
+		for _, channel := range s.targetChannels(msg) {
+			s.localLayer.add(channel, command.Groups...)
+		}
+		return
+	case common.CommandGroupDiscard:
+		for _, channel := range s.targetChannels(msg) {
+			s.localLayer.discard(channel, command.Groups...)
+		}
+		return
+	}
+	for _, channel := range s.targetChannels(msg) {
+		if client, ok := s.Clients.Get(channel); ok {
+			go s.runCommand(client, command)
+		}
+	}
+}
+
+func (s *Server) runCommand(client *Client, command common.Command) {
+	switch command.Action {
+	case common.CommandClose:
+		code := command.Code
+		if code == 0 {
+			code = websocket.CloseNormalClosure
+		}
+		client.disconnect(code, command.Reason)
+	case common.CommandLeave:
+		for _, group := range command.Groups {
+			if err := client.Leave(group); err != nil {
+				s.log().Warn("force leave failed", "channel", client.Channel, "group", group, "error", err)
+			}
+		}
+	case common.CommandRefreshAuth:
+		if s.OnRefreshAuth == nil {
+			return
+		}
+		if err := s.OnRefreshAuth(client, command.Data); err != nil {
+			client.disconnect(CloseAuthFailed, err.Error())
+		}
+	default:
+		s.log().Warn("unknown command", "action", command.Action, "channel", client.Channel)
+	}
+}
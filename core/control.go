@@ -0,0 +1,143 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"ws-channels/common"
+)
+
+// 客户端可以发送的控制消息类型
+const (
+	ControlSubscribe   = "subscribe"
+	ControlUnsubscribe = "unsubscribe"
+	ControlPublish     = "publish"
+	ControlAck         = "ack"
+	ControlPing        = "ping"
+)
+
+// 服务端回复的控制消息类型
+const (
+	ControlReply = "reply"
+	ControlPong  = "pong"
+	// ControlRateLimited 超过限制的消息被丢弃, Code 为 CloseRateLimited
+	ControlRateLimited = "rate_limited"
+	// ControlMessage 开启 group 历史时带序号的 group 消息, 见 GroupMessage
+	ControlMessage = "message"
+)
+
+var (
+	ErrGroupRequired = errors.New("group is required")
+	ErrForbidden     = errors.New("forbidden")
+)
+
+// ControlRequest 客户端发送的控制消息, 例如 {"type":"subscribe","id":"1","group":"room"};
+// subscribe 带上 since 时补发序号大于 since 的历史消息
+type ControlRequest struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id,omitempty"`
+	Group string          `json:"group,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Since *uint64         `json:"since,omitempty"`
+}
+
+// ControlResponse 服务端对控制消息的回复, 没有 id 的请求不回复(ping 除外)
+type ControlResponse struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Code  int    `json:"code,omitempty"`
+}
+
+// GroupMessage 开启 ControlProtocol 和 group 历史时, 文本 group 消息包装成这个格式发给客户端,
+// 例如 {"type":"message","group":"room","seq":5,"data":{"text":"hi"}}; 重连后用 subscribe 的 since 补发.
+// data 不是 JSON 时编码为 JSON 字符串
+type GroupMessage struct {
+	Type  string          `json:"type"`
+	Group string          `json:"group"`
+	Seq   uint64          `json:"seq"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// groupMessage 按 GroupMessage 包装带序号的文本消息, 没有开启 ControlProtocol 或没有序号时原样返回
+func (s *Server) groupMessage(group string, seq uint64, message common.Message) common.Message {
+	if !s.ControlProtocol || seq == 0 || message.MessageType != websocket.TextMessage {
+		return message
+	}
+	data := json.RawMessage(message.Data)
+	if !json.Valid(message.Data) {
+		data, _ = json.Marshal(string(message.Data))
+	}
+	wrapped, err := json.Marshal(GroupMessage{Type: ControlMessage, Group: group, Seq: seq, Data: data})
+	if err != nil {
+		return message
+	}
+	return common.Message{MessageType: websocket.TextMessage, Data: wrapped}
+}
+
+// handleControl 处理控制消息, 返回 false 表示不是控制消息, 需要交给 OnMessage
+func (s *Server) handleControl(messageType int, data []byte, client *Client) bool {
+	if messageType != websocket.TextMessage {
+		return false
+	}
+	var req ControlRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		s.log().Debug("not a control message", "channel", client.Channel, "error", err)
+		return false
+	}
+
+	var err error
+	switch req.Type {
+	case ControlSubscribe:
+		if err = s.authorize(client, req.Type, req.Group); err == nil {
+			if req.Since != nil {
+				err = client.GroupReplay(req.Group, *req.Since)
+			} else {
+				err = client.GroupAdd(req.Group)
+			}
+		}
+	case ControlUnsubscribe:
+		if err = s.authorize(client, req.Type, req.Group); err == nil {
+			err = client.GroupDiscard(req.Group)
+		}
+	case ControlPublish:
+		if err = s.authorize(client, req.Type, req.Group); err == nil {
+			err = client.GroupSend(websocket.TextMessage, req.Data, req.Group)
+		}
+	case ControlAck:
+		if s.OnAck != nil {
+			s.OnAck(req.ID, client)
+		}
+	case ControlPing:
+		client.reply(ControlResponse{Type: ControlPong, ID: req.ID, OK: true})
+		return true
+	default:
+		return false
+	}
+
+	if req.ID != "" && req.Type != ControlAck {
+		resp := ControlResponse{Type: ControlReply, ID: req.ID, OK: err == nil}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		client.reply(resp)
+	}
+	return true
+}
+
+func (s *Server) authorize(client *Client, action string, group string) error {
+	if group == "" {
+		return ErrGroupRequired
+	}
+	// 退出 group 总是允许的
+	if action != ControlUnsubscribe && s.Authorize != nil && !s.Authorize(client, action, group) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (c *Client) reply(resp ControlResponse) {
+	data, _ := json.Marshal(resp)
+	_ = c.Send(websocket.TextMessage, data)
+}
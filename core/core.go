@@ -2,7 +2,6 @@ package core
 
 import (
 	"github.com/gorilla/websocket"
-	"net/http"
 	"time"
 )
 
@@ -11,12 +10,18 @@ const (
 	FromServer = 2
 )
 
+// CloseHeartbeatTimeout 心跳超时或写超时断开连接时 OnDisconnect 收到的 code
+const CloseHeartbeatTimeout = 4000
+
+const (
+	DefaultPingInterval = 50 * time.Second
+	DefaultPongWait     = 60 * time.Second
+	DefaultWriteWait    = 10 * time.Second
+)
+
+// DefaultUpgrader 只允许同源的浏览器连接, 其他来源通过 config.Config.AllowedOrigins 或 AllowOrigins 设置
 var DefaultUpgrader = websocket.Upgrader{
 	ReadBufferSize:   1024,
 	WriteBufferSize:  1024,
 	HandshakeTimeout: 5 * time.Second,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
 }
-
@@ -1,61 +1,354 @@
 package core
 
 import (
+	"context"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"ws-channels/common"
+	"ws-channels/logger"
 )
 
-type MemoryLayer struct {
-	clients map[string]*Client
-	groups  *sync.Map
+// groupSet 记录 group 与 channel 的对应关系, 并发安全
+type groupSet struct {
+	mu      sync.RWMutex
+	groups  map[string]map[string]bool
+	expires map[string]time.Time
+}
+
+func newGroupSet() *groupSet {
+	return &groupSet{
+		groups:  make(map[string]map[string]bool),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (g *groupSet) add(channel string, groups ...string) {
+	g.addWithExpiry(channel, 0, groups...)
 }
 
-func (l MemoryLayer) getChanelsMap(group string) (map[string]bool, error) {
-	if v, loaded := l.groups.Load(group); loaded {
-		if value, ok := v.(map[string]bool); ok {
-			return value, nil
+// addWithExpiry 与 redis 的 EXPIRE 一致, 每次加入都会刷新整个 group 的过期时间, expiry 为 0 时不过期
+func (g *groupSet) addWithExpiry(channel string, expiry time.Duration, groups ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, group := range groups {
+		if g.expired(group, now) {
+			delete(g.groups, group)
+		}
+		if value, ok := g.groups[group]; ok {
+			value[channel] = true
+		} else {
+			g.groups[group] = map[string]bool{channel: true}
+		}
+		if expiry > 0 {
+			g.expires[group] = now.Add(expiry)
+		} else {
+			delete(g.expires, group)
 		}
 	}
-	return map[string]bool{}, nil
 }
 
-func (l MemoryLayer) GetChannels(group string) ([]string, error) {
-	if value, err := l.getChanelsMap(group); value != nil {
-		result := make([]string, 0, len(value))
-		for key, _ := range value {
-			result = append(result, key)
+// entries 返回每个 channel 加入的 group
+func (g *groupSet) entries() map[string][]string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	result := make(map[string][]string)
+	for group, channels := range g.groups {
+		for channel := range channels {
+			result[channel] = append(result[channel], group)
 		}
-		return result, nil
-	} else if err != nil {
-		return []string{}, err
-	} else {
-		return []string{}, nil
 	}
+	return result
+}
 
+func (g *groupSet) expired(group string, now time.Time) bool {
+	deadline, ok := g.expires[group]
+	return ok && !now.Before(deadline)
 }
 
-func (l MemoryLayer) GroupAdd(channel string, groups ...string) error {
+func (g *groupSet) discard(channel string, groups ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	for _, group := range groups {
-		if v, loaded := l.groups.LoadOrStore(group, map[string]bool{channel: true}); loaded {
-			if value, ok := v.(map[string]bool); ok {
-				value[channel] = true
+		if value, ok := g.groups[group]; ok {
+			delete(value, channel)
+			if len(value) == 0 {
+				delete(g.groups, group)
+				delete(g.expires, group)
 			}
 		}
 	}
+}
 
-	return nil
+// discardNode 从所有 group 中移除节点的 channel
+func (g *groupSet) discardNode(node string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	prefix := node + "!"
+	for group, channels := range g.groups {
+		for channel := range channels {
+			if strings.HasPrefix(channel, prefix) {
+				delete(channels, channel)
+			}
+		}
+		if len(channels) == 0 {
+			delete(g.groups, group)
+			delete(g.expires, group)
+		}
+	}
+}
+
+func (g *groupSet) contains(group string, channel string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.groups[group][channel] && !g.expired(group, time.Now())
 }
 
-func (l MemoryLayer) GroupDiscard(channel string, groups ...string) error {
+// channels 返回多个 group 中 channel 的并集
+func (g *groupSet) channels(groups ...string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	now := time.Now()
+	seen := make(map[string]bool)
+	result := make([]string, 0)
 	for _, group := range groups {
-		if v, loaded := l.groups.Load(group); loaded {
-			if value, ok := v.(map[string]bool); ok {
-				delete(value, channel)
-				if len(value) == 0 {
-					l.groups.Delete(group)
-				}
+		if g.expired(group, now) {
+			continue
+		}
+		for channel := range g.groups[group] {
+			if !seen[channel] {
+				seen[channel] = true
+				result = append(result, channel)
 			}
 		}
 	}
+	return result
+}
+
+// MemoryBroker 进程内的消息中转, 共享同一个 broker 的 MemoryLayer 之间可以互相投递消息
+type MemoryBroker struct {
+	groups   *groupSet
+	users    *groupSet
+	history  *historyStore
+	offline  *offlineQueue
+	presence *presenceSet
+
+	mu    sync.RWMutex
+	nodes map[string]chan common.ReceiverLayerMessage
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		groups:   newGroupSet(),
+		users:    newGroupSet(),
+		history:  newHistoryStore(),
+		offline:  newOfflineQueue(),
+		presence: newPresenceSet(),
+		nodes:    make(map[string]chan common.ReceiverLayerMessage),
+	}
+}
+
+func (b *MemoryBroker) register(node string, receiver chan common.ReceiverLayerMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nodes[node] = receiver
+}
+
+// unregister 节点停止后不再接收消息, 并清理它在 group 和用户中的 channel
+func (b *MemoryBroker) unregister(node string) {
+	b.mu.Lock()
+	delete(b.nodes, node)
+	b.mu.Unlock()
+	b.groups.discardNode(node)
+	b.users.discardNode(node)
+}
+
+// Nodes 返回所有已注册的节点
+func (b *MemoryBroker) Nodes() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	result := make([]string, 0, len(b.nodes))
+	for node := range b.nodes {
+		result = append(result, node)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (b *MemoryBroker) deliver(node string, msg common.ReceiverLayerMessage) {
+	b.mu.RLock()
+	receiver, ok := b.nodes[node]
+	b.mu.RUnlock()
+	if ok {
+		receiver <- msg
+	}
+}
+
+// MemoryLayer 进程内实现的 LayerInterface, 适用于单节点部署和单元测试
+type MemoryLayer struct {
+	GroupExpiry     int
+	ReceiverMessage chan common.ReceiverLayerMessage
+	// Codec 投递到其他节点的消息会用它编码再解码一次, 与 redis layer 的行为一致, 默认为 JSON
+	Codec common.Codec
+	// HistorySize 每个 group 保留的最近消息数, HistoryTTL 保留的时长, 都为 0 时不保留历史
+	HistorySize int
+	HistoryTTL  time.Duration
+	// Logger 输出后台任务中的错误, 默认为 logger.Default
+	Logger logger.Logger
+
+	clientPrefix string
+	broker       *MemoryBroker
+	tasks        sync.WaitGroup
+}
+
+// NewMemoryLayer broker 为 nil 时使用独立的 broker
+func NewMemoryLayer(receiverMessage chan common.ReceiverLayerMessage, broker *MemoryBroker) *MemoryLayer {
+	if broker == nil {
+		broker = NewMemoryBroker()
+	}
+	layer := &MemoryLayer{
+		GroupExpiry:     86400,
+		ReceiverMessage: receiverMessage,
+		Codec:           common.JSONCodec,
+		Logger:          logger.Default,
+		clientPrefix:    common.RandomString(8),
+		broker:          broker,
+	}
+	broker.register(layer.clientPrefix, receiverMessage)
+	return layer
+}
+
+func (l *MemoryLayer) GetChannels(group string) ([]string, error) {
+	return l.broker.groups.channels(group), nil
+}
 
+func (l *MemoryLayer) GroupAdd(channel string, groups ...string) error {
+	l.broker.groups.addWithExpiry(channel, time.Duration(l.GroupExpiry)*time.Second, groups...)
 	return nil
 }
+
+func (l *MemoryLayer) GroupDiscard(channel string, groups ...string) error {
+	l.broker.groups.discard(channel, groups...)
+	return nil
+}
+
+func (l *MemoryLayer) UserAdd(user string, channel string) error {
+	l.broker.users.addWithExpiry(channel, time.Duration(l.GroupExpiry)*time.Second, user)
+	return nil
+}
+
+func (l *MemoryLayer) UserDiscard(user string, channel string) error {
+	l.broker.users.discard(channel, user)
+	return nil
+}
+
+func (l *MemoryLayer) GetUserChannels(user string) ([]string, error) {
+	return l.broker.users.channels(user), nil
+}
+
+func (l *MemoryLayer) GroupSend(message common.Message, groups ...string) error {
+	var seq []uint64
+	if l.historyEnabled() && message.MessageType != common.CommandMessageType {
+		seq = make([]uint64, len(groups))
+		for i, group := range groups {
+			seq[i] = l.broker.history.push(group, message, l.HistorySize, l.HistoryTTL, l.historyExpiry())
+		}
+	}
+	channels := l.broker.groups.channels(groups...)
+	for _, node := range l.channelsToNodes(channels) {
+		if err := l.deliver(node, common.ReceiverLayerMessage{
+			Message: message,
+			Groups:  groups,
+			Seq:     seq,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *MemoryLayer) Send(message common.Message, channels ...string) error {
+	for _, channel := range channels {
+		if err := l.deliver(l.noneLocalName(channel), common.ReceiverLayerMessage{
+			Message:  message,
+			Channels: []string{channel},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *MemoryLayer) NewChannel(user string) string {
+	if user == "" {
+		user = common.RandomString(8)
+	}
+	return l.clientPrefix + "!" + user
+}
+
+func (l *MemoryLayer) Nodes() ([]string, error) {
+	return l.broker.Nodes(), nil
+}
+
+func (l *MemoryLayer) Run(ctx context.Context) error {
+	l.tasks.Add(1)
+	go func() {
+		defer l.tasks.Done()
+		<-ctx.Done()
+		l.broker.unregister(l.clientPrefix)
+		// 停止的节点上的连接不会再主动离开, 由这里通知其他节点
+		for _, event := range l.broker.presence.discardNode(l.clientPrefix) {
+			message, err := common.PresenceMessage(event)
+			if err == nil {
+				err = l.GroupSend(message, event.Group)
+			}
+			if err != nil {
+				l.Logger.Warn("presence leave failed", "node", l.clientPrefix, "group", event.Group, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (l *MemoryLayer) Wait() {
+	l.tasks.Wait()
+}
+
+// deliver 投递到其他节点的消息经过 Codec 编解码, 本节点的消息直接投递
+func (l *MemoryLayer) deliver(node string, msg common.ReceiverLayerMessage) error {
+	if node != l.clientPrefix && l.Codec != nil {
+		data, err := l.Codec.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		msg = common.ReceiverLayerMessage{}
+		if err := l.Codec.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+	}
+	l.broker.deliver(node, msg)
+	return nil
+}
+
+// channelsToNodes 返回这些 channel 所在的节点, group 消息每个节点只需要投递一次
+func (l *MemoryLayer) channelsToNodes(channels []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, channel := range channels {
+		node := l.noneLocalName(channel)
+		if !seen[node] {
+			seen[node] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+func (l *MemoryLayer) noneLocalName(channel string) string {
+	if position := strings.Index(channel, "!"); position > -1 {
+		return channel[:position]
+	}
+	return channel
+}
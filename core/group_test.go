@@ -0,0 +1,63 @@
+package core
+
+import (
+	"testing"
+	"time"
+	"ws-channels/common"
+	"ws-channels/layer/layertest"
+)
+
+func TestMemoryLayer(t *testing.T) {
+	broker := NewMemoryBroker()
+	layertest.Suite{
+		New: func(receiverMessage chan common.ReceiverLayerMessage) common.LayerInterface {
+			return NewMemoryLayer(receiverMessage, broker)
+		},
+		SetExpiry: func(layer common.LayerInterface, expiry time.Duration) {
+			layer.(*MemoryLayer).GroupExpiry = int(expiry / time.Second)
+		},
+		SetHistory: func(layer common.LayerInterface, size int, ttl time.Duration) {
+			layer.(*MemoryLayer).HistorySize, layer.(*MemoryLayer).HistoryTTL = size, ttl
+		},
+	}.Run(t)
+}
+
+func TestMemoryLayerCodecs(t *testing.T) {
+	for _, codec := range []common.Codec{common.MsgPackCodec, common.ProtobufCodec} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			broker := NewMemoryBroker()
+			layertest.Suite{
+				New: func(receiverMessage chan common.ReceiverLayerMessage) common.LayerInterface {
+					layer := NewMemoryLayer(receiverMessage, broker)
+					layer.Codec = codec
+					return layer
+				},
+				SetExpiry: func(layer common.LayerInterface, expiry time.Duration) {
+					layer.(*MemoryLayer).GroupExpiry = int(expiry / time.Second)
+				},
+			}.Run(t)
+		})
+	}
+}
+
+// TestHistoryEviction 超过 expiry 没有新消息的 group 被清理
+func TestHistoryEviction(t *testing.T) {
+	h := newHistoryStore()
+	message := common.Message{MessageType: 1, Data: []byte("old")}
+	h.push("idle", message, 10, 0, time.Minute)
+	h.push("ttl", message, 10, time.Second, time.Minute)
+	h.groups["idle"].last = time.Now().Add(-2 * time.Minute)
+	h.groups["ttl"].last = time.Now().Add(-2 * time.Minute)
+
+	if messages := h.since("idle", 0, 0, time.Minute); len(messages) != 0 {
+		t.Errorf("expired group returned %+v", messages)
+	}
+	h.lastSweep = time.Time{}
+	if seq := h.push("active", message, 10, 0, time.Minute); seq != 1 {
+		t.Errorf("seq %d, want 1", seq)
+	}
+	if len(h.groups) != 1 {
+		t.Errorf("groups not evicted: %d left", len(h.groups))
+	}
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"sync"
+	"time"
+	"ws-channels/common"
+)
+
+// historySweepInterval 多久清理一次长时间没有新消息的 group
+const historySweepInterval = time.Minute
+
+// historyStore 每个 group 一个有界的消息缓冲区, 超过 size 或 ttl 的消息被丢弃;
+// 与 redis 的 EXPIRE 一致, 超过 expiry 没有新消息的 group 连同序号一起移除
+type historyStore struct {
+	mu        sync.Mutex
+	groups    map[string]*groupHistory
+	lastSweep time.Time
+}
+
+type groupHistory struct {
+	seq     uint64
+	last    time.Time
+	entries []common.HistoryMessage
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{groups: make(map[string]*groupHistory)}
+}
+
+// push 写入消息并返回它的序号
+func (h *historyStore) push(group string, message common.Message, size int, ttl time.Duration, expiry time.Duration) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if now.Sub(h.lastSweep) > historySweepInterval {
+		h.lastSweep = now
+		h.sweep(expiry, now)
+	}
+	history, ok := h.groups[group]
+	if !ok || history.expired(expiry, now) {
+		history = &groupHistory{}
+		h.groups[group] = history
+	}
+	history.seq++
+	history.last = now
+	history.entries = append(history.entries, common.HistoryMessage{Seq: history.seq, Time: now, Message: message})
+	history.trim(size, ttl, now)
+	return history.seq
+}
+
+// sweep 移除过期的 group, 没有新消息的 group 不会再调用 push, 需要定期清理
+func (h *historyStore) sweep(expiry time.Duration, now time.Time) {
+	for group, history := range h.groups {
+		if history.expired(expiry, now) {
+			delete(h.groups, group)
+		}
+	}
+}
+
+func (h *historyStore) since(group string, since uint64, ttl time.Duration, expiry time.Duration) []common.HistoryMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	history, ok := h.groups[group]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if history.expired(expiry, now) {
+		delete(h.groups, group)
+		return nil
+	}
+	history.trim(0, ttl, now)
+	result := make([]common.HistoryMessage, 0)
+	for _, entry := range history.entries {
+		if entry.Seq > since {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// expired expiry 为 0 时不过期
+func (g *groupHistory) expired(expiry time.Duration, now time.Time) bool {
+	return expiry > 0 && now.Sub(g.last) > expiry
+}
+
+// trim 丢弃超出数量或已过期的消息, 复制剩余部分以释放底层数组
+func (g *groupHistory) trim(size int, ttl time.Duration, now time.Time) {
+	start := 0
+	if size > 0 && len(g.entries) > size {
+		start = len(g.entries) - size
+	}
+	if ttl > 0 {
+		for start < len(g.entries) && now.Sub(g.entries[start].Time) > ttl {
+			start++
+		}
+	}
+	if start > 0 {
+		g.entries = append([]common.HistoryMessage(nil), g.entries[start:]...)
+	}
+}
+
+func (l *MemoryLayer) historyEnabled() bool {
+	return l.HistorySize > 0 || l.HistoryTTL > 0
+}
+
+// historyExpiry 与 redis layer 一致, 历史和序号至少保留 GroupExpiry
+func (l *MemoryLayer) historyExpiry() time.Duration {
+	expiry := time.Duration(l.GroupExpiry) * time.Second
+	if l.HistoryTTL > expiry {
+		expiry = l.HistoryTTL
+	}
+	return expiry
+}
+
+func (l *MemoryLayer) GroupHistory(group string, since uint64) ([]common.HistoryMessage, error) {
+	if !l.historyEnabled() {
+		return nil, nil
+	}
+	return l.broker.history.since(group, since, l.HistoryTTL, l.historyExpiry()), nil
+}
+
+// GroupHistory 返回 group 中序号大于 since 的历史消息
+func (s *Server) GroupHistory(group string, since uint64) ([]common.HistoryMessage, error) {
+	return s.Layer.GroupHistory(group, since)
+}
+
+// GroupReplay 加入 group 后补发序号大于 since 的历史消息, 加入和补发之间发送的消息可能会重复收到,
+// 开启 ControlProtocol 时客户端可以按 GroupMessage 的序号去重
+func (c *Client) GroupReplay(group string, since uint64) error {
+	if err := c.GroupAdd(group); err != nil {
+		return err
+	}
+	messages, err := c.server.GroupHistory(group, since)
+	if err != nil {
+		return err
+	}
+	// 与实时的 group 消息一样经过中间件和 OnMessage
+	for _, entry := range messages {
+		message := c.server.groupMessage(group, entry.Seq, entry.Message)
+		c.server.message(message.MessageType, message.Data, FromServer, c)
+	}
+	return nil
+}
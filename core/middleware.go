@@ -0,0 +1,110 @@
+package core
+
+import "net/http"
+
+// ConnectHandler 与 Server.OnConnect 相同, 调用 next 完成连接, 不调用 next 则拒绝连接
+type ConnectHandler func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error)
+
+// MessageHandler 与 Server.OnMessage 相同
+type MessageHandler func(messageType int, data []byte, from int, client *Client)
+
+// DisconnectHandler 与 Server.OnDisconnect 相同
+type DisconnectHandler func(code int, reason string, client *Client)
+
+// Middleware 包装连接、消息和断开事件的处理函数, 为 nil 的字段不处理对应的事件;
+// 中间件不调用下一层即可中断处理 (中断连接时需要自己写入 HTTP 响应), 也可以修改参数后再调用下一层
+type Middleware struct {
+	Connect    func(next ConnectHandler) ConnectHandler
+	Message    func(next MessageHandler) MessageHandler
+	Disconnect func(next DisconnectHandler) DisconnectHandler
+}
+
+// Use 添加中间件, 先添加的在外层先执行, 最内层是 OnConnect、OnMessage 和 OnDisconnect;
+// 处理函数在第一次处理事件时组合, 之后添加的中间件和设置的 OnConnect 等不再生效, 需要在开始处理连接之前调用
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// handlerChain 组合好的处理函数, 第一次处理事件时组合一次
+type handlerChain struct {
+	connect    ConnectHandler
+	message    MessageHandler
+	disconnect DisconnectHandler
+}
+
+// chain OnConnect、OnMessage、OnDisconnect 可以在 Use 之后设置, 所以在第一次使用时才组合
+func (s *Server) chain() *handlerChain {
+	s.handlersOnce.Do(func() {
+		s.handlers = handlerChain{
+			connect:    s.connectHandler(),
+			message:    s.messageHandler(),
+			disconnect: s.disconnectHandler(),
+		}
+	})
+	return &s.handlers
+}
+
+// connect 依次经过中间件后交给 OnConnect
+func (s *Server) connect(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error) {
+	s.chain().connect(resp, req, client, next)
+}
+
+func (s *Server) message(messageType int, data []byte, from int, client *Client) {
+	s.chain().message(messageType, data, from, client)
+}
+
+func (s *Server) disconnect(code int, reason string, client *Client) {
+	s.chain().disconnect(code, reason, client)
+}
+
+// connectHandler 没有 OnConnect 时以令牌的 Subject 完成连接, 没有令牌时随机生成 channel 名称
+func (s *Server) connectHandler() ConnectHandler {
+	handler := ConnectHandler(s.OnConnect)
+	if handler == nil {
+		handler = func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error) {
+			name := ""
+			if claims := client.Claims(); claims != nil {
+				name = claims.Subject
+			}
+			_ = next(name)
+		}
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		if s.middleware[i].Connect != nil {
+			handler = s.middleware[i].Connect(handler)
+		}
+	}
+	return handler
+}
+
+// messageHandler 没有 OnMessage 时其他节点的消息直接发给客户端
+func (s *Server) messageHandler() MessageHandler {
+	handler := MessageHandler(s.OnMessage)
+	if handler == nil {
+		handler = func(messageType int, data []byte, from int, client *Client) {
+			if from == FromServer {
+				// 队列已满丢弃的消息由 Dropped 计数, 不在这里报错
+				_ = client.Send(messageType, data)
+			}
+		}
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		if s.middleware[i].Message != nil {
+			handler = s.middleware[i].Message(handler)
+		}
+	}
+	return handler
+}
+
+func (s *Server) disconnectHandler() DisconnectHandler {
+	handler := DisconnectHandler(s.OnDisconnect)
+	if handler == nil {
+		handler = func(int, string, *Client) {}
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		if s.middleware[i].Disconnect != nil {
+			handler = s.middleware[i].Disconnect(handler)
+		}
+	}
+	return handler
+}
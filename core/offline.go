@@ -0,0 +1,265 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+	"ws-channels/common"
+)
+
+const (
+	offlineMinSweepInterval = 100 * time.Millisecond
+	offlineMaxSweepInterval = time.Minute
+)
+
+// offlineChannels 本节点上断开的具名 channel, 发给它们的消息会进入离线队列;
+// channel 名称包含节点前缀, 发给它们的消息总是投递到本节点, 所以只需要在本地记录
+type offlineChannels struct {
+	mu       sync.Mutex
+	channels map[string]*offlineChannel
+}
+
+type offlineChannel struct {
+	// until 之前的消息进入离线队列, last 最后一条离线消息的时间
+	until time.Time
+	last  time.Time
+}
+
+func newOfflineChannels() *offlineChannels {
+	return &offlineChannels{channels: make(map[string]*offlineChannel)}
+}
+
+func (o *offlineChannels) add(channel string, ttl time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.channels[channel] = &offlineChannel{until: time.Now().Add(ttl)}
+}
+
+func (o *offlineChannels) remove(channel string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.channels, channel)
+}
+
+// push channel 仍在离线期间时记录消息时间并返回 true
+func (o *offlineChannels) push(channel string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c, ok := o.channels[channel]
+	now := time.Now()
+	if !ok || !now.Before(c.until) {
+		return false
+	}
+	c.last = now
+	return true
+}
+
+// expired 移除离线期已过并且所有消息都已超过 ttl 的 channel, 返回其中有离线消息的 channel
+func (o *offlineChannels) expired(ttl time.Duration) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	result := make([]string, 0)
+	for channel, c := range o.channels {
+		if now.Before(c.until) || now.Sub(c.last) <= ttl {
+			continue
+		}
+		delete(o.channels, channel)
+		if !c.last.IsZero() {
+			result = append(result, channel)
+		}
+	}
+	return result
+}
+
+func (s *Server) offlineEnabled() bool {
+	return s.OfflineMaxLen > 0 && s.OfflineTTL > 0
+}
+
+// goOffline 具名客户端断开后开始为它的 channel 缓存消息
+func (s *Server) goOffline(client *Client) {
+	// DuplicateMulti 的 channel 每次连接都不同, 不会有重新连接的客户端
+	if s.offlineEnabled() && client.User != "" && s.DuplicatePolicy != DuplicateMulti {
+		s.offline.add(client.Channel, s.OfflineTTL)
+		// 第一次有客户端离线时才启动清理, 这时配置已经确定
+		s.offlineSweep.Do(func() {
+			s.tasks.Add(1)
+			go func() {
+				defer s.tasks.Done()
+				s.offlineSweepTask(s.Ctx)
+			}()
+		})
+	}
+}
+
+// offlinePush 只缓存直接发给这个 channel 的消息, group 消息可以通过 GroupReplay 补发
+func (s *Server) offlinePush(channel string, msg common.ReceiverLayerMessage) error {
+	if !s.offlineEnabled() || !containsString(msg.Channels, channel) || !s.offline.push(channel) {
+		return nil
+	}
+	dropped, err := s.Layer.OfflinePush(channel, msg.Message, s.OfflineMaxLen, s.OfflineTTL)
+	if err != nil {
+		return err
+	}
+	s.offlineExpired(channel, dropped)
+	return nil
+}
+
+// offlineDrain 重新连接后按顺序补发离线期间缓存的消息, 之后再处理补发期间到达的实时消息;
+// 补发的消息与实时消息一样经过中间件和 OnMessage
+func (s *Server) offlineDrain(client *Client) {
+	defer client.release()
+	if !s.offlineEnabled() || client.User == "" {
+		return
+	}
+	s.offline.remove(client.Channel)
+	messages, expired, err := s.Layer.OfflineDrain(client.Channel, s.OfflineTTL)
+	if err != nil {
+		s.log().Warn("offline drain failed", "channel", client.Channel, "error", err)
+		return
+	}
+	s.offlineExpired(client.Channel, expired)
+	for _, message := range messages {
+		s.message(message.MessageType, message.Data, FromServer, client)
+	}
+}
+
+// hold 补发离线消息期间暂存实时消息, 返回 false 时由调用方直接处理
+func (c *Client) hold(message common.Message) bool {
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	if !c.holding {
+		return false
+	}
+	c.held = append(c.held, message)
+	return true
+}
+
+// release 按顺序处理暂存的消息, 处理期间到达的消息继续暂存, 直到全部处理完
+func (c *Client) release() {
+	for {
+		c.holdMu.Lock()
+		held := c.held
+		c.held = nil
+		if len(held) == 0 {
+			c.holding = false
+			c.holdMu.Unlock()
+			return
+		}
+		c.holdMu.Unlock()
+		for _, message := range held {
+			c.server.message(message.MessageType, message.Data, FromServer, c)
+		}
+	}
+}
+
+// offlineSweepTask 定期报告再也不会被补发的离线消息: 离线期已过的 channel 在消息全部超过 OfflineTTL 后清空,
+// 没有重新连接的客户端也会触发 OnOfflineExpire
+func (s *Server) offlineSweepTask(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(s.offlineSweepInterval()):
+		case <-ctx.Done():
+			return
+		}
+		for _, channel := range s.offline.expired(s.OfflineTTL) {
+			messages, expired, err := s.Layer.OfflineDrain(channel, s.OfflineTTL)
+			if err != nil {
+				s.log().Warn("offline sweep failed", "channel", channel, "error", err)
+				continue
+			}
+			s.offlineExpired(channel, append(expired, messages...))
+		}
+	}
+}
+
+// offlineSweepInterval 为 OfflineTTL 的一半, 保证在 redis 的队列过期之前完成报告
+func (s *Server) offlineSweepInterval() time.Duration {
+	interval := s.OfflineTTL / 2
+	if interval < offlineMinSweepInterval {
+		return offlineMinSweepInterval
+	}
+	if interval > offlineMaxSweepInterval {
+		return offlineMaxSweepInterval
+	}
+	return interval
+}
+
+func (s *Server) offlineExpired(channel string, messages []common.Message) {
+	if len(messages) > 0 && s.OnOfflineExpire != nil {
+		s.OnOfflineExpire(channel, messages)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// offlineQueue 内存实现的离线队列
+type offlineQueue struct {
+	mu     sync.Mutex
+	queues map[string][]offlineEntry
+}
+
+type offlineEntry struct {
+	time    time.Time
+	message common.Message
+}
+
+func newOfflineQueue() *offlineQueue {
+	return &offlineQueue{queues: make(map[string][]offlineEntry)}
+}
+
+// push 追加消息, 返回因为超过 maxLen 或 ttl 被丢弃的消息
+func (q *offlineQueue) push(channel string, message common.Message, maxLen int, ttl time.Duration) []common.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	entries := append(q.queues[channel], offlineEntry{time: now, message: message})
+	start := 0
+	if maxLen > 0 && len(entries) > maxLen {
+		start = len(entries) - maxLen
+	}
+	for ttl > 0 && start < len(entries) && now.Sub(entries[start].time) > ttl {
+		start++
+	}
+	var dropped []common.Message
+	if start > 0 {
+		for _, entry := range entries[:start] {
+			dropped = append(dropped, entry.message)
+		}
+		entries = append([]offlineEntry(nil), entries[start:]...)
+	}
+	q.queues[channel] = entries
+	return dropped
+}
+
+func (q *offlineQueue) drain(channel string, ttl time.Duration) (messages []common.Message, expired []common.Message) {
+	q.mu.Lock()
+	entries := q.queues[channel]
+	delete(q.queues, channel)
+	q.mu.Unlock()
+	now := time.Now()
+	for _, entry := range entries {
+		if ttl > 0 && now.Sub(entry.time) > ttl {
+			expired = append(expired, entry.message)
+		} else {
+			messages = append(messages, entry.message)
+		}
+	}
+	return messages, expired
+}
+
+func (l *MemoryLayer) OfflinePush(channel string, message common.Message, maxLen int, ttl time.Duration) ([]common.Message, error) {
+	return l.broker.offline.push(channel, message, maxLen, ttl), nil
+}
+
+func (l *MemoryLayer) OfflineDrain(channel string, ttl time.Duration) ([]common.Message, []common.Message, error) {
+	messages, expired := l.broker.offline.drain(channel, ttl)
+	return messages, expired, nil
+}
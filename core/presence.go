@@ -0,0 +1,150 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"ws-channels/common"
+)
+
+// presenceSet 内存实现的 presence, group -> channel -> 信息
+type presenceSet struct {
+	mu     sync.RWMutex
+	groups map[string]map[string]common.PresenceInfo
+}
+
+func newPresenceSet() *presenceSet {
+	return &presenceSet{groups: make(map[string]map[string]common.PresenceInfo)}
+}
+
+func (p *presenceSet) add(group string, info common.PresenceInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.groups[group] == nil {
+		p.groups[group] = make(map[string]common.PresenceInfo)
+	}
+	p.groups[group][info.Channel] = info
+}
+
+func (p *presenceSet) discard(group string, channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if infos, ok := p.groups[group]; ok {
+		delete(infos, channel)
+		if len(infos) == 0 {
+			delete(p.groups, group)
+		}
+	}
+}
+
+func (p *presenceSet) list(group string) []common.PresenceInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	result := make([]common.PresenceInfo, 0, len(p.groups[group]))
+	for _, info := range p.groups[group] {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Channel < result[j].Channel
+	})
+	return result
+}
+
+// discardNode 移除节点的所有 channel, 返回被移除的 group 和信息
+func (p *presenceSet) discardNode(node string) []common.PresenceEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefix := node + "!"
+	var removed []common.PresenceEvent
+	for group, infos := range p.groups {
+		for channel, info := range infos {
+			if strings.HasPrefix(channel, prefix) {
+				delete(infos, channel)
+				removed = append(removed, common.PresenceEvent{Type: common.PresenceLeave, Group: group, PresenceInfo: info})
+			}
+		}
+		if len(infos) == 0 {
+			delete(p.groups, group)
+		}
+	}
+	return removed
+}
+
+func (l *MemoryLayer) PresenceAdd(group string, info common.PresenceInfo) error {
+	l.broker.presence.add(group, info)
+	return nil
+}
+
+func (l *MemoryLayer) PresenceDiscard(group string, channel string) error {
+	l.broker.presence.discard(group, channel)
+	return nil
+}
+
+func (l *MemoryLayer) Presence(group string) ([]common.PresenceInfo, error) {
+	return l.broker.presence.list(group), nil
+}
+
+// Presence 返回 group 中在线的连接
+func (s *Server) Presence(group string) ([]common.PresenceInfo, error) {
+	return s.Layer.Presence(group)
+}
+
+func (s *Server) presenceSend(event common.PresenceEvent) error {
+	message, err := common.PresenceMessage(event)
+	if err != nil {
+		return err
+	}
+	return s.Layer.GroupSend(message, event.Group)
+}
+
+// Join 加入 group 并记录在线状态, group 中的所有连接(包括自己)会收到 join 事件; 断开时自动 Leave
+func (c *Client) Join(group string, meta map[string]string) error {
+	if err := c.GroupAdd(group); err != nil {
+		return err
+	}
+	info := common.PresenceInfo{Channel: c.Channel, User: clientUser(c), JoinedAt: time.Now(), Meta: meta}
+	if err := c.server.Layer.PresenceAdd(group, info); err != nil {
+		return err
+	}
+	c.presenceMu.Lock()
+	if c.presence == nil {
+		c.presence = make(map[string]common.PresenceInfo)
+	}
+	c.presence[group] = info
+	c.presenceMu.Unlock()
+	return c.server.presenceSend(common.PresenceEvent{Type: common.PresenceJoin, Group: group, PresenceInfo: info})
+}
+
+// Leave 离开 group, group 中的其他连接会收到 leave 事件
+func (c *Client) Leave(group string) error {
+	c.presenceMu.Lock()
+	info, ok := c.presence[group]
+	delete(c.presence, group)
+	c.presenceMu.Unlock()
+	if err := c.server.Layer.PresenceDiscard(group, c.Channel); err != nil {
+		return err
+	}
+	if err := c.GroupDiscard(group); err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return c.server.presenceSend(common.PresenceEvent{Type: common.PresenceLeave, Group: group, PresenceInfo: info})
+}
+
+// leaveAll 断开时离开所有通过 Join 加入的 group
+func (c *Client) leaveAll() {
+	c.presenceMu.Lock()
+	groups := make([]string, 0, len(c.presence))
+	for group := range c.presence {
+		groups = append(groups, group)
+	}
+	c.presenceMu.Unlock()
+	for _, group := range groups {
+		if err := c.Leave(group); err != nil {
+			c.server.log().Warn("presence leave failed", "channel", c.Channel, "group", group, "error", err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"ws-channels/metrics"
+)
+
+// RateLimitAction 超过限制时的处理方式
+type RateLimitAction int
+
+const (
+	RateLimitDrop       RateLimitAction = 0 // 丢弃这条消息
+	RateLimitWarn       RateLimitAction = 1 // 丢弃这条消息, 开启 ControlProtocol 时发送 rate_limited 控制消息, code 为 CloseRateLimited
+	RateLimitDisconnect RateLimitAction = 2 // 以 CloseRateLimited 断开连接
+)
+
+// CloseRateLimited 超过限制时断开连接或警告使用的 code
+const CloseRateLimited = 4005
+
+// limiterSweepInterval 多久清理一次已经补满的 IP 令牌桶
+const limiterSweepInterval = time.Minute
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit 令牌桶的参数, 每秒补充 Rate 个令牌, 最多积累 Burst 个; Rate 为 0 时不限制
+type RateLimit struct {
+	Rate   float64
+	Burst  int
+	Action RateLimitAction
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// burst 桶的容量, 至少为 1
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// tokenBucket 零值为装满的桶
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// warned 本次超过限制已经警告过, 再次允许时重置
+	warned bool
+}
+
+func (b *tokenBucket) allow(limit RateLimit, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	burst := limit.burst()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	b.warned = false
+	return true
+}
+
+// warn 超过限制后第一次调用时返回 true, 同一次限制期间只警告一次
+func (b *tokenBucket) warn() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.warned {
+		return false
+	}
+	b.warned = true
+	return true
+}
+
+// full 桶已经补满, 可以丢弃
+func (b *tokenBucket) full(limit RateLimit, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst()
+}
+
+// limiterSet 按 key 分别限制, 定期清理已经补满的桶
+type limiterSet struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newLimiterSet() *limiterSet {
+	return &limiterSet{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *limiterSet) allow(key string, limit RateLimit) bool {
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		l.lastSweep = now
+		for k, bucket := range l.buckets {
+			if bucket.full(limit, now) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.allow(limit, now)
+}
+
+// RateLimited 因为超过限制被拒绝的连接和消息总数
+func (s *Server) RateLimited() uint64 {
+	return atomic.LoadUint64(&s.rateLimited)
+}
+
+func (s *Server) rateLimit(kind string) {
+	atomic.AddUint64(&s.rateLimited, 1)
+	s.collector().Add(metrics.RateLimitedTotal, 1, "limit", kind)
+}
+
+// clientIP 默认使用 RemoteAddr, 部署在代理之后时通过 ClientIP 从请求头中读取
+func (s *Server) clientIP(req *http.Request) string {
+	if s.ClientIP != nil {
+		return s.ClientIP(req)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// allowConnection 超过 ConnectionRateLimit 时以 429 拒绝连接
+func (s *Server) allowConnection(resp http.ResponseWriter, req *http.Request) bool {
+	if !s.ConnectionRateLimit.enabled() {
+		return true
+	}
+	ip := s.clientIP(req)
+	if s.connectionLimiter.allow(ip, s.ConnectionRateLimit) {
+		return true
+	}
+	s.rateLimit("connection")
+	s.log().Warn("connection rate limited", "ip", ip)
+	http.Error(resp, ErrRateLimited.Error(), http.StatusTooManyRequests)
+	return false
+}
+
+// allowMessage 客户端发来的消息是否在 MessageRateLimit 之内, 超过时按 Action 处理;
+// Action 为 RateLimitDisconnect 时连接已经断开, readLoop 随 ctx 结束
+func (c *Client) allowMessage() bool {
+	limit := c.server.MessageRateLimit
+	if !limit.enabled() || c.messageBucket.allow(limit, time.Now()) {
+		return true
+	}
+	c.rateLimited("message", limit.Action, &c.messageBucket)
+	return false
+}
+
+// allowPublish 发布到 group 是否在 PublishRateLimit 之内
+func (c *Client) allowPublish() error {
+	limit := c.server.PublishRateLimit
+	if !limit.enabled() || c.publishBucket.allow(limit, time.Now()) {
+		return nil
+	}
+	c.rateLimited("publish", limit.Action, &c.publishBucket)
+	return ErrRateLimited
+}
+
+// rateLimited 每条超过限制的消息都计数, 日志和警告在每次超过限制时只发一次
+func (c *Client) rateLimited(kind string, action RateLimitAction, bucket *tokenBucket) {
+	c.server.rateLimit(kind)
+	switch action {
+	case RateLimitWarn:
+		if !bucket.warn() {
+			return
+		}
+		c.server.log().Warn("client rate limited", "channel", c.Channel, "limit", kind)
+		if c.server.ControlProtocol {
+			c.reply(ControlResponse{Type: ControlRateLimited, Code: CloseRateLimited, Error: ErrRateLimited.Error()})
+		}
+	case RateLimitDisconnect:
+		c.server.log().Warn("client rate limited, disconnecting", "channel", c.Channel, "limit", kind)
+		c.disconnect(CloseRateLimited, ErrRateLimited.Error())
+	}
+}
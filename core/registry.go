@@ -0,0 +1,172 @@
+package core
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+const registryShards = 32
+
+// Registry 并发安全的客户端注册表, 按 channel 分片加锁
+type Registry struct {
+	shards [registryShards]registryShard
+
+	usersMu sync.RWMutex
+	users   map[string]map[*Client]bool
+}
+
+type registryShard struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{users: make(map[string]map[*Client]bool)}
+	for i := range r.shards {
+		r.shards[i].clients = make(map[string]*Client)
+	}
+	return r
+}
+
+func (r *Registry) shard(channel string) *registryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(channel))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+// Add 注册客户端, 返回同一个 channel 上被替换掉的客户端
+func (r *Registry) Add(client *Client) *Client {
+	shard := r.shard(client.Channel)
+	shard.mu.Lock()
+	old := shard.clients[client.Channel]
+	shard.clients[client.Channel] = client
+	shard.mu.Unlock()
+
+	r.usersMu.Lock()
+	defer r.usersMu.Unlock()
+	if old != nil {
+		r.removeUser(old)
+	}
+	r.addUser(client)
+	return old
+}
+
+// AddIfAbsent channel 没有被占用时才注册客户端
+func (r *Registry) AddIfAbsent(client *Client) bool {
+	shard := r.shard(client.Channel)
+	shard.mu.Lock()
+	if _, ok := shard.clients[client.Channel]; ok {
+		shard.mu.Unlock()
+		return false
+	}
+	shard.clients[client.Channel] = client
+	shard.mu.Unlock()
+
+	r.usersMu.Lock()
+	defer r.usersMu.Unlock()
+	r.addUser(client)
+	return true
+}
+
+// Remove 只有 channel 当前注册的仍然是这个客户端时才会移除
+func (r *Registry) Remove(client *Client) bool {
+	shard := r.shard(client.Channel)
+	shard.mu.Lock()
+	current, ok := shard.clients[client.Channel]
+	if !ok || current != client {
+		shard.mu.Unlock()
+		return false
+	}
+	delete(shard.clients, client.Channel)
+	shard.mu.Unlock()
+
+	r.usersMu.Lock()
+	defer r.usersMu.Unlock()
+	r.removeUser(client)
+	return true
+}
+
+func (r *Registry) addUser(client *Client) {
+	user := clientUser(client)
+	if r.users[user] == nil {
+		r.users[user] = make(map[*Client]bool)
+	}
+	r.users[user][client] = true
+}
+
+func (r *Registry) removeUser(client *Client) {
+	user := clientUser(client)
+	if clients, ok := r.users[user]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+func (r *Registry) Get(channel string) (*Client, bool) {
+	shard := r.shard(channel)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	client, ok := shard.clients[channel]
+	return client, ok
+}
+
+// ByUser 返回本节点上属于这个用户的所有客户端
+func (r *Registry) ByUser(user string) []*Client {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+	result := make([]*Client, 0, len(r.users[user]))
+	for client := range r.users[user] {
+		result = append(result, client)
+	}
+	return result
+}
+
+func (r *Registry) Count() int {
+	count := 0
+	for i := range r.shards {
+		r.shards[i].mu.RLock()
+		count += len(r.shards[i].clients)
+		r.shards[i].mu.RUnlock()
+	}
+	return count
+}
+
+// Range 遍历所有客户端, f 返回 false 时停止; 遍历的是每个分片的快照, f 中可以安全地修改注册表
+func (r *Registry) Range(f func(client *Client) bool) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		clients := make([]*Client, 0, len(shard.clients))
+		for _, client := range shard.clients {
+			clients = append(clients, client)
+		}
+		shard.mu.RUnlock()
+		for _, client := range clients {
+			if !f(client) {
+				return
+			}
+		}
+	}
+}
+
+// clientUser 优先使用 Client.User, 随机生成的 channel 使用名称中的用户部分
+func clientUser(client *Client) string {
+	if client.User != "" {
+		return client.User
+	}
+	return channelUser(client.Channel)
+}
+
+// channelUser 返回 channel 名称中的用户部分, channel 的格式为 节点!用户
+func channelUser(channel string) string {
+	if position := strings.Index(channel, "!"); position > -1 {
+		channel = channel[position+1:]
+	}
+	if position := strings.Index(channel, "!"); position > -1 {
+		channel = channel[:position]
+	}
+	return channel
+}
@@ -2,28 +2,81 @@ package core
 
 import (
 	"context"
-	"fmt"
 	"github.com/gorilla/websocket"
-	"log"
 	"net/http"
 	"sync"
 	"time"
 	"ws-channels/common"
 	"ws-channels/config"
 	"ws-channels/layer/redis"
+	"ws-channels/logger"
+	"ws-channels/metrics"
 )
 
 type Server struct {
-	Layer                common.LayerInterface
-	Clients              map[string]*Client
-	OnConnect            func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error)
-	OnDisconnect         func(code int, reason string, client *Client)
-	OnMessage            func(messageType int, data []byte, From int, client *Client)
-	Ctx                  context.Context
+	dropped     uint64
+	rateLimited uint64
+	closing     int32
+
+	Layer        common.LayerInterface
+	Clients      *Registry
+	OnConnect    func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error)
+	OnDisconnect func(code int, reason string, client *Client)
+	OnMessage    func(messageType int, data []byte, From int, client *Client)
+	Ctx          context.Context
+	// PingInterval 发送 ping 的间隔, 为 0 时不发送
+	PingInterval time.Duration
+	// PongWait 超过这个时间没有收到任何消息(包括 pong)就断开连接, 为 0 时不限制
+	PongWait time.Duration
+	// WriteWait 单次写入的超时时间, 为 0 时不限制
+	WriteWait time.Duration
+	// SendPolicy 客户端发送队列已满时的默认处理方式, 可以通过 Client.SetSendPolicy 覆盖;
+	// NewServer 默认为 SendDropOldest, SendBlock 会让一个慢客户端阻塞所有 layer 消息的分发, 需要显式开启
+	SendPolicy SendPolicy
+	// SendTimeout SendBlock 策略的最长等待时间, 为 0 时一直阻塞
+	SendTimeout time.Duration
+	// SendQueueSize 每个客户端发送队列的长度
+	SendQueueSize int
+	// DuplicatePolicy 本节点上多个连接使用相同 channel 名称时的处理方式
+	DuplicatePolicy DuplicatePolicy
+	// ControlProtocol 开启后客户端可以通过 JSON 控制消息订阅、退订和发布 group, 控制消息不会交给 OnMessage
+	ControlProtocol bool
+	// Authorize 决定客户端能否订阅(subscribe)或发布(publish)到 group, 为 nil 时全部允许
+	Authorize func(client *Client, action string, group string) bool
+	// OnAck 收到客户端的 ack 控制消息
+	OnAck func(id string, client *Client)
+	// OfflineMaxLen 具名客户端离线期间最多缓存的消息数, OfflineTTL 缓存的时长, 都大于 0 时才开启离线队列
+	OfflineMaxLen int
+	OfflineTTL    time.Duration
+	// OnOfflineExpire 离线消息因为超过 OfflineTTL 或 OfflineMaxLen 被丢弃, 客户端没有重新连接时也会调用
+	OnOfflineExpire func(channel string, messages []common.Message)
+	// MessageRateLimit 每个客户端发来的消息, PublishRateLimit 每个 channel 发布到 group 的消息,
+	// ConnectionRateLimit 每个 IP 新建的连接(超过时以 429 拒绝, 忽略 Action)
+	MessageRateLimit    RateLimit
+	PublishRateLimit    RateLimit
+	ConnectionRateLimit RateLimit
+	// ClientIP 返回连接限制使用的客户端 IP, 为 nil 时使用 RemoteAddr
+	ClientIP func(req *http.Request) string
+	// Authenticator 不为 nil 时升级之前校验请求, 通过后 Client.Claims 返回令牌信息
+	Authenticator Authenticator
+	// Logger 输出连接、layer 和命令的错误, 由 config.Config.Logger 设置, 默认为 logger.Default
+	Logger logger.Logger
+	// OnRefreshAuth 收到 RefreshAuth 命令时重新校验连接的权限, 返回错误时以 CloseAuthFailed 断开连接
+	OnRefreshAuth        func(client *Client, data []byte) error
+	metrics              metrics.Collector
 	receiverLayerMessage chan common.ReceiverLayerMessage
-	receiverGroupMessage chan common.ReceiverLayerMessage
 	upgrader             websocket.Upgrader
-	localLayer           MemoryLayer
+	localLayer           *groupSet
+	offline              *offlineChannels
+	offlineSweep         sync.Once
+	middleware           []Middleware
+	handlers             handlerChain
+	handlersOnce         sync.Once
+	node                 string
+	nodeOnce             sync.Once
+	connectionLimiter    *limiterSet
+	cancel               context.CancelFunc
+	tasks                sync.WaitGroup
 }
 
 func NewServer(
@@ -34,111 +87,271 @@ func NewServer(
 	onMessage func(messageType int, data []byte, From int, client *Client),
 ) *Server {
 	receiverMessage := make(chan common.ReceiverLayerMessage, 500)
+	ctx, cancel := context.WithCancel(ctx)
+	log := c.Logger
+	if log == nil {
+		log = logger.Default
+	}
 
 	server := &Server{
-		Clients:              make(map[string]*Client),
+		Clients:              NewRegistry(),
 		OnConnect:            onConnect,
 		OnDisconnect:         OnDisconnect,
 		OnMessage:            onMessage,
 		Ctx:                  ctx,
+		PingInterval:         DefaultPingInterval,
+		PongWait:             DefaultPongWait,
+		WriteWait:            DefaultWriteWait,
+		SendPolicy:           SendDropOldest,
+		SendTimeout:          DefaultSendTimeout,
+		SendQueueSize:        DefaultSendQueueSize,
+		Logger:               log,
 		receiverLayerMessage: receiverMessage,
 		upgrader:             DefaultUpgrader,
-		localLayer:           MemoryLayer{groups: new(sync.Map)},
+		offline:              newOfflineChannels(),
+		localLayer:           newGroupSet(),
+		connectionLimiter:    newLimiterSet(),
+		cancel:               cancel,
+	}
+	if len(c.AllowedOrigins) > 0 {
+		server.upgrader.CheckOrigin = AllowOrigins(c.AllowedOrigins...)
 	}
+	if c.AuthSecret != "" {
+		server.Authenticator = NewHMACAuthenticator([]byte(c.AuthSecret))
+	}
+	codec := newCodec(c.Codec)
 	switch c.Layer {
 	case config.RedisLayer:
-		server.Layer = redis.NewLayer(receiverMessage, c.RedisConfig)
+		layer := redis.NewLayer(receiverMessage, c.RedisConfig)
+		layer.Codec = codec
+		layer.HistorySize, layer.HistoryTTL = c.HistorySize, c.HistoryTTL
+		layer.Logger = log
+		server.Layer = layer
+	case config.MemoryLayer:
+		layer := NewMemoryLayer(receiverMessage, nil)
+		layer.Codec = codec
+		layer.HistorySize, layer.HistoryTTL = c.HistorySize, c.HistoryTTL
+		layer.Logger = log
+		server.Layer = layer
 	default:
+		cancel()
 		return nil
 	}
+	if c.Metrics != nil {
+		server.SetMetrics(c.Metrics)
+	}
 
 	return server
 }
 
+func newCodec(codec config.CodecEnum) common.Codec {
+	switch codec {
+	case config.MsgPackCodec:
+		return common.MsgPackCodec
+	case config.ProtobufCodec:
+		return common.ProtobufCodec
+	default:
+		return common.JSONCodec
+	}
+}
+
 func (s *Server) SetUpgrade(Upgrader websocket.Upgrader) {
 	s.upgrader = Upgrader
 }
 
+// SetMetrics 设置服务端和 layer 使用的 Collector, 必须在 Run 之前调用, nil 表示不收集;
+// collector 为 *metrics.Registry 时导出前会采样队列长度
+func (s *Server) SetMetrics(collector metrics.Collector) {
+	if collector == nil {
+		collector = metrics.Discard
+	}
+	s.metrics = collector
+	if layer, ok := s.Layer.(*redis.Layer); ok {
+		layer.Metrics = collector
+	}
+	if registry, ok := collector.(*metrics.Registry); ok {
+		registry.Register(s)
+	}
+}
+
+func (s *Server) log() logger.Logger {
+	if s.Logger == nil {
+		return logger.Discard
+	}
+	return s.Logger
+}
+
+func (s *Server) collector() metrics.Collector {
+	if s.metrics == nil {
+		return metrics.Discard
+	}
+	return s.metrics
+}
+
+// Sample 更新连接数和队列长度
+func (s *Server) Sample(collector metrics.Collector) {
+	depth, maxDepth := 0, 0
+	s.Clients.Range(func(client *Client) bool {
+		n := len(client.outChan)
+		depth += n
+		if n > maxDepth {
+			maxDepth = n
+		}
+		return true
+	})
+	collector.Set(metrics.Connections, float64(s.Clients.Count()))
+	collector.Set(metrics.SendQueueDepth, float64(depth))
+	collector.Set(metrics.SendQueueMaxDepth, float64(maxDepth))
+	collector.Set(metrics.LayerQueueDepth, float64(len(s.receiverLayerMessage)))
+	if sampler, ok := s.Layer.(metrics.Sampler); ok {
+		sampler.Sample(collector)
+	}
+}
+
 func (s *Server) Handler(resp http.ResponseWriter, req *http.Request) {
+	if s.isClosing() {
+		http.Error(resp, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.allowConnection(resp, req) {
+		return
+	}
 
 	ctx, cancel := context.WithCancel(s.Ctx)
 
 	client := &Client{
-		Channel:  "",
-		Req:      req,
-		cancel:   cancel,
-		inChan:   nil,
-		outChan:  nil,
-		wsSocket: nil,
-		server:   s,
+		Channel:    "",
+		Req:        req,
+		sendPolicy: int32(sendPolicyInherit),
+		ctx:        ctx,
+		cancel:     cancel,
+		outChan:    nil,
+		wsSocket:   nil,
+		server:     s,
+	}
+	if !s.authenticate(resp, req, client) {
+		cancel()
+		return
 	}
 
+	connected := false
 	next := func(channelName string) error {
-		if channelName == "" {
-			client.Channel = s.Layer.NewChannel(channelName)
-		} else {
-			client.Channel = s.Layer.NewChannel("")
+		channel, err := s.channelName(channelName)
+		if err != nil {
+			status := http.StatusBadRequest
+			if err == ErrChannelTaken {
+				status = http.StatusConflict
+			}
+			http.Error(resp, err.Error(), status)
+			return err
 		}
-		wsSocket, err := s.upgrader.Upgrade(resp, req, nil)
+		client.Channel = channel
+		client.User = channelName
+		wsSocket, err := s.upgrader.Upgrade(resp, req, client.upgradeHeader())
 		if err != nil {
-			log.Println("升级为websocket失败", err.Error())
+			s.log().Warn("websocket upgrade failed", "channel", channel, "error", err)
 			return err
 		}
 		wsSocket.SetCloseHandler(func(code int, reason string) error {
-			if client.isClose == false {
-				client.isClose = true
-				client.cancel()
-				_ = wsSocket.Close()
-				if s.OnDisconnect != nil {
-					s.OnDisconnect(code, reason, client)
-				}
-				if _, ok := s.Clients[client.Channel]; ok {
-					delete(s.Clients, client.Channel)
-				}
-			}
+			client.finish(code, reason)
 			return nil
 		})
 		client.wsSocket = wsSocket
-		client.inChan = make(chan string, 1000)
-		client.outChan = make(chan common.Message, 1000)
-		s.Clients[client.Channel] = client
-		go client.readLoop(ctx)
+		client.outChan = make(chan common.Message, s.SendQueueSize)
+		client.drain = make(chan struct{})
+		// 注册之后到达的实时消息等离线消息补发完成后再处理
+		client.holding = s.offlineEnabled() && client.User != ""
+		if err := s.register(client); err != nil {
+			return err
+		}
+		s.collector().Add(metrics.ConnectionsTotal, 1)
+		client.watchExpiry()
+		if client.User != "" {
+			if err := s.Layer.UserAdd(client.User, client.Channel); err != nil {
+				s.log().Warn("user add failed", "channel", client.Channel, "user", client.User, "error", err)
+			}
+		}
+		if s.isClosing() {
+			// Shutdown 遍历客户端之后才完成注册的连接
+			client.goAway()
+		}
 		go client.writeLoop(ctx)
+		s.offlineDrain(client)
+		go client.readLoop(ctx)
+		connected = true
 
 		return err
 	}
 
-	if s.OnConnect != nil {
-		s.OnConnect(resp, req, client, next)
-	} else {
-		_ = next("")
+	s.connect(resp, req, client, next)
+	// 中间件或 OnConnect 拒绝了连接, 或者 next 失败, 释放 client 的 ctx
+	if !connected {
+		cancel()
 	}
+}
 
+func (s *Server) sendToChannel(channel string, msg common.ReceiverLayerMessage) error {
+	if client, ok := s.Clients.Get(channel); ok {
+		message := msg.Message
+		if group, seq := s.groupSeq(channel, msg); seq > 0 {
+			message = s.groupMessage(group, seq, message)
+		}
+		if !client.hold(message) {
+			s.message(message.MessageType, message.Data, FromServer, client)
+		}
+		return nil
+	}
+	return s.offlinePush(channel, msg)
 }
 
-func (s Server) sendToChannel(channel string, msg common.ReceiverLayerMessage) error {
-	if client, ok := s.Clients[channel]; ok {
-		s.OnMessage(msg.Message.MessageType, msg.Message.Data, FromServer, client)
+// groupSeq channel 通过哪个 group 收到这条消息以及消息在其中的序号, 没有序号时返回 0
+func (s *Server) groupSeq(channel string, msg common.ReceiverLayerMessage) (string, uint64) {
+	for i, group := range msg.Groups {
+		if i < len(msg.Seq) && msg.Seq[i] > 0 && s.localLayer.contains(group, channel) {
+			return group, msg.Seq[i]
+		}
+	}
+	return "", 0
+}
 
+// targetChannels 合并消息指定的 channel 和本地 group 成员, 同一个 channel 只投递一次
+func (s *Server) targetChannels(msg common.ReceiverLayerMessage) []string {
+	if len(msg.Groups) == 0 {
+		return msg.Channels
 	}
-	return nil
+	channels := s.localLayer.channels(msg.Groups...)
+	if len(msg.Channels) == 0 {
+		return channels
+	}
+	seen := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		seen[channel] = true
+	}
+	for _, channel := range msg.Channels {
+		if !seen[channel] {
+			seen[channel] = true
+			channels = append(channels, channel)
+		}
+	}
+	return channels
 }
 
-func (s Server) receiverLayerTask(ctx context.Context) {
+func (s *Server) receiverLayerTask(ctx context.Context) {
 	for {
 		select {
 		case msg := <-s.receiverLayerMessage:
-			if len(msg.Channels) > 0 {
-				for _, channel := range msg.Channels {
+			s.collector().Add(metrics.LayerMessagesTotal, 1)
+			if msg.Message.MessageType == common.CommandMessageType {
+				s.handleCommand(msg)
+			} else {
+				for _, channel := range s.targetChannels(msg) {
 					if err := s.sendToChannel(channel, msg); err != nil {
-						fmt.Println(err)
+						s.log().Warn("send to channel failed", "channel", channel, "error", err)
 					}
-
 				}
 			}
-			if len(msg.Groups) > 0 {
-				// todo
-				panic("not implement")
+			if msg.Ack != nil {
+				msg.Ack()
 			}
 		case <-ctx.Done():
 			return
@@ -146,13 +359,20 @@ func (s Server) receiverLayerTask(ctx context.Context) {
 	}
 }
 
-func (s Server) Run() {
-	go s.receiverLayerTask(s.Ctx)
-	go s.Layer.Run(s.Ctx)
+func (s *Server) Run() {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		s.receiverLayerTask(s.Ctx)
+	}()
+
+	if err := s.Layer.Run(s.Ctx); err != nil {
+		s.log().Error("layer run failed", "error", err)
+	}
 }
 
 func (c *Client) Close(code int, reason string) {
-	if c.isClose {
+	if c.ctx.Err() != nil {
 		return
 	}
 	c.wsSocket.WriteControl(
@@ -161,25 +381,42 @@ func (c *Client) Close(code int, reason string) {
 		time.Now().Add(3*time.Second))
 }
 
-func (s Server) Send(messageType int, data []byte, channels ...string) error {
-	return s.Layer.Send(common.Message{MessageType: messageType, Data: data,}, channels...)
+func (s *Server) Send(messageType int, data []byte, channels ...string) error {
+	return s.Layer.Send(common.Message{MessageType: messageType, Data: data}, channels...)
+}
+
+// SendToUser 发送给用户在所有节点上的所有连接
+func (s *Server) SendToUser(user string, messageType int, data []byte) error {
+	channels, err := s.Layer.GetUserChannels(user)
+	if err != nil {
+		return err
+	}
+	return s.Send(messageType, data, channels...)
 }
-func (s Server) GroupAdd(channel string, groups ...string) error {
+
+// GroupAdd channel 可以在其他节点上, 这时由 channel 所在的节点记录本地成员, 之后的 group 消息才能在那里展开
+func (s *Server) GroupAdd(channel string, groups ...string) error {
 	if err := s.Layer.GroupAdd(channel, groups...); err != nil {
 		return err
 	}
-	s.localLayer.GroupAdd(channel, groups...)
+	if !s.isLocal(channel) {
+		return s.sendCommand(common.Command{Action: common.CommandGroupAdd, Groups: groups}, channel)
+	}
+	s.localLayer.add(channel, groups...)
 	return nil
 }
-func (s Server) GroupDiscard(channel string, groups ...string) error {
+func (s *Server) GroupDiscard(channel string, groups ...string) error {
 	if err := s.Layer.GroupDiscard(channel, groups...); err != nil {
 		return err
 	}
-	s.localLayer.GroupDiscard(channel, groups...)
+	if !s.isLocal(channel) {
+		return s.sendCommand(common.Command{Action: common.CommandGroupDiscard, Groups: groups}, channel)
+	}
+	s.localLayer.discard(channel, groups...)
 	return nil
 
 }
-func (s Server) GroupSend(messageType int, data []byte, groups ...string) error {
+func (s *Server) GroupSend(messageType int, data []byte, groups ...string) error {
 	return s.Layer.GroupSend(common.Message{
 		MessageType: messageType,
 		Data:        data,
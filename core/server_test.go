@@ -0,0 +1,1013 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"ws-channels/common"
+	"ws-channels/config"
+	"ws-channels/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestServer(t *testing.T) (*Server, string) {
+	return newBrokerServer(t, nil)
+}
+
+// newBrokerServer broker 不为 nil 时, 使用同一个 broker 的服务端组成一个集群
+func newBrokerServer(t *testing.T, broker *MemoryBroker) (*Server, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	server := NewServer(&config.Config{Layer: config.MemoryLayer}, ctx,
+		func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error) {
+			if next("") == nil {
+				_ = client.GroupAdd("all")
+			}
+		},
+		func(code int, reason string, client *Client) {
+			_ = client.GroupDiscard("all")
+		},
+		func(messageType int, data []byte, from int, client *Client) {
+			if from == FromLocal {
+				_ = client.GroupSend(messageType, data, "all")
+			} else {
+				client.Send(messageType, data)
+			}
+		},
+	)
+	if broker != nil {
+		server.Layer = NewMemoryLayer(server.receiverLayerMessage, broker)
+	}
+	server.Run()
+	httpServer := httptest.NewServer(http.HandlerFunc(server.Handler))
+	t.Cleanup(httpServer.Close)
+	return server, "ws" + strings.TrimPrefix(httpServer.URL, "http")
+}
+
+func dial(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestConnectionStorm 并发连接、发送和断开, 配合 -race 检查客户端注册表
+func TestConnectionStorm(t *testing.T) {
+	server, url := newTestServer(t)
+	const clients, messages = 20, 10
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				server.Clients.Range(func(client *Client) bool {
+					_, _ = server.Clients.Get(client.Channel)
+					return true
+				})
+				_ = server.Clients.Count()
+			}
+		}
+	}()
+	defer close(stop)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := dial(t, url)
+			defer conn.Close()
+			for j := 0; j < messages; j++ {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte("storm")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.Error(err)
+			}
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Clients.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := server.Clients.Count(); count != 0 {
+		t.Errorf("%d clients left after disconnect", count)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	a := &Client{Channel: "node!alice"}
+	b := &Client{Channel: "node!alice!phone"}
+	c := &Client{Channel: "node!bob"}
+	for _, client := range []*Client{a, b, c} {
+		r.Add(client)
+	}
+	if r.Count() != 3 || len(r.ByUser("alice")) != 2 || len(r.ByUser("bob")) != 1 {
+		t.Fatal("unexpected registry state")
+	}
+	if client, ok := r.Get("node!bob"); !ok || client != c {
+		t.Error("lookup by channel")
+	}
+
+	replaced := &Client{Channel: "node!bob"}
+	if old := r.Add(replaced); old != c {
+		t.Error("replaced client not returned")
+	}
+	if r.Remove(c) {
+		t.Error("stale client removed the replacement")
+	}
+	if !r.Remove(replaced) || !r.Remove(a) || len(r.ByUser("bob")) != 0 || len(r.ByUser("alice")) != 1 {
+		t.Error("remove")
+	}
+}
+
+// TestHeartbeatTimeout 不回复 pong 的客户端在 PongWait 后被断开
+func TestHeartbeatTimeout(t *testing.T) {
+	server, url := newTestServer(t)
+	server.PingInterval = 50 * time.Millisecond
+	server.PongWait = 200 * time.Millisecond
+	codes := make(chan int, 1)
+	server.OnDisconnect = func(code int, reason string, client *Client) {
+		codes <- code
+	}
+
+	// 不读取消息的连接不会处理 ping, 也就不会回复 pong
+	conn := dial(t, url)
+	defer conn.Close()
+
+	select {
+	case code := <-codes:
+		if code != CloseHeartbeatTimeout {
+			t.Errorf("close code %d, want %d", code, CloseHeartbeatTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle client not disconnected")
+	}
+}
+
+// TestShutdown 关闭时发送完队列中的消息, 以 CloseGoingAway 断开并离开所有 group
+func TestShutdown(t *testing.T) {
+	server, url := newTestServer(t)
+	conn := dial(t, url)
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Clients.Count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var client *Client
+	server.Clients.Range(func(c *Client) bool {
+		client = c
+		return false
+	})
+	// 在 Shutdown 之前直接放入队列, 模拟尚未发送的消息
+	for i := 0; i < 3; i++ {
+		_ = client.Send(websocket.TextMessage, []byte("queued"))
+	}
+	// 其他节点的 channel 不应该被本节点移除
+	remote := "remote-node!user"
+	_ = server.Layer.GroupAdd(remote, "all")
+	server.localLayer.add(remote, "all")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := 0
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("unexpected close: %v", err)
+			}
+			break
+		}
+		if string(data) == "queued" {
+			received++
+		}
+	}
+	if received != 3 {
+		t.Errorf("received %d queued messages, want 3", received)
+	}
+	if channels, _ := server.Layer.GetChannels("all"); len(channels) != 1 || channels[0] != remote {
+		t.Errorf("channels left in group: %v, want only %s", channels, remote)
+	}
+
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d after shutdown", resp.StatusCode)
+	}
+}
+
+// newNamedServer 用查询参数 user 作为 channel 名称
+func newNamedServer(t *testing.T, policy DuplicatePolicy) (*Server, string, chan int) {
+	server, url := newTestServer(t)
+	server.DuplicatePolicy = policy
+	server.OnConnect = func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error) {
+		_ = next(req.URL.Query().Get("user"))
+	}
+	codes := make(chan int, 10)
+	server.OnDisconnect = func(code int, reason string, client *Client) {
+		codes <- code
+	}
+	return server, url + "?user=alice", codes
+}
+
+func waitCount(server *Server, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Clients.Count() != count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNamedChannel(t *testing.T) {
+	t.Run("Kick", func(t *testing.T) {
+		server, url, codes := newNamedServer(t, DuplicateKick)
+		first := dial(t, url)
+		defer first.Close()
+		waitCount(server, 1)
+		second := dial(t, url)
+		defer second.Close()
+
+		if code := <-codes; code != CloseReplaced {
+			t.Errorf("close code %d, want %d", code, CloseReplaced)
+		}
+		channel := server.Layer.NewChannel("alice")
+		if err := server.Send(websocket.TextMessage, []byte("hello"), channel); err != nil {
+			t.Fatal(err)
+		}
+		_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := second.ReadMessage(); err != nil || string(data) != "hello" {
+			t.Errorf("named channel send: %q %v", data, err)
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		server, url, _ := newNamedServer(t, DuplicateReject)
+		first := dial(t, url)
+		defer first.Close()
+		waitCount(server, 1)
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+			t.Errorf("duplicate connection not rejected: %v", err)
+		}
+	})
+
+	t.Run("Multi", func(t *testing.T) {
+		server, url, _ := newNamedServer(t, DuplicateMulti)
+		first := dial(t, url)
+		defer first.Close()
+		second := dial(t, url)
+		defer second.Close()
+		waitCount(server, 2)
+		if clients := server.Clients.ByUser("alice"); len(clients) != 2 {
+			t.Errorf("%d clients for alice, want 2", len(clients))
+		}
+	})
+}
+
+func TestSendToUser(t *testing.T) {
+	server, url, _ := newNamedServer(t, DuplicateMulti)
+	phone := dial(t, url)
+	defer phone.Close()
+	laptop := dial(t, url)
+	defer laptop.Close()
+	waitCount(server, 2)
+
+	if err := server.SendToUser("alice", websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*websocket.Conn{phone, laptop} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hi" {
+			t.Errorf("device did not receive message: %q %v", data, err)
+		}
+	}
+	server.Clients.Range(func(client *Client) bool {
+		if client.User != "alice" {
+			t.Errorf("client user %q", client.User)
+		}
+		return true
+	})
+
+	_ = phone.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	waitCount(server, 1)
+	if channels, _ := server.Layer.GetUserChannels("alice"); len(channels) != 1 {
+		t.Errorf("user channels after disconnect: %v", channels)
+	}
+}
+
+func readControl(t *testing.T, conn *websocket.Conn) ControlResponse {
+	t.Helper()
+	var resp ControlResponse
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestControlProtocol(t *testing.T) {
+	server, url := newTestServer(t)
+	server.ControlProtocol = true
+	server.Authorize = func(client *Client, action string, group string) bool {
+		return group != "private"
+	}
+	conn := dial(t, url)
+	defer conn.Close()
+
+	_ = conn.WriteJSON(ControlRequest{Type: ControlPing, ID: "0"})
+	if resp := readControl(t, conn); resp.Type != ControlPong || resp.ID != "0" {
+		t.Errorf("ping: %+v", resp)
+	}
+
+	_ = conn.WriteJSON(ControlRequest{Type: ControlSubscribe, ID: "1", Group: "room"})
+	if resp := readControl(t, conn); !resp.OK || resp.ID != "1" {
+		t.Errorf("subscribe: %+v", resp)
+	}
+	_ = conn.WriteJSON(ControlRequest{Type: ControlSubscribe, ID: "2", Group: "private"})
+	if resp := readControl(t, conn); resp.OK || resp.Error != ErrForbidden.Error() {
+		t.Errorf("forbidden subscribe: %+v", resp)
+	}
+
+	_ = conn.WriteJSON(ControlRequest{Type: ControlPublish, Group: "room", Data: []byte(`{"text":"hi"}`)})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != `{"text":"hi"}` {
+		t.Errorf("publish: %q %v", data, err)
+	}
+
+	_ = conn.WriteJSON(ControlRequest{Type: ControlUnsubscribe, ID: "3", Group: "room"})
+	if resp := readControl(t, conn); !resp.OK {
+		t.Errorf("unsubscribe: %+v", resp)
+	}
+	if channels, _ := server.Layer.GetChannels("room"); len(channels) != 0 {
+		t.Errorf("channels left in room: %v", channels)
+	}
+}
+
+func TestGroupReplay(t *testing.T) {
+	server, url := newTestServer(t)
+	server.ControlProtocol = true
+	server.Layer.(*MemoryLayer).HistorySize = 10
+	// 补发的历史消息与实时消息一样经过中间件
+	var replayed int32
+	server.Use(Middleware{Message: func(next MessageHandler) MessageHandler {
+		return func(messageType int, data []byte, from int, client *Client) {
+			if from == FromServer {
+				atomic.AddInt32(&replayed, 1)
+			}
+			next(messageType, data, from, client)
+		}
+	}})
+	for i := 1; i <= 3; i++ {
+		if err := server.GroupSend(websocket.TextMessage, []byte(fmt.Sprint(i)), "replay"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := dial(t, url)
+	defer conn.Close()
+
+	expect := func(seq uint64, data string) {
+		t.Helper()
+		var message GroupMessage
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&message); err != nil || message.Type != ControlMessage ||
+			message.Group != "replay" || message.Seq != seq || string(message.Data) != data {
+			t.Fatalf("got %+v %v, want seq %d data %s", message, err, seq, data)
+		}
+	}
+
+	since := uint64(1)
+	_ = conn.WriteJSON(ControlRequest{Type: ControlSubscribe, ID: "1", Group: "replay", Since: &since})
+	expect(2, "2")
+	expect(3, "3")
+	if n := atomic.LoadInt32(&replayed); n != 2 {
+		t.Errorf("%d replayed messages passed the middleware, want 2", n)
+	}
+	if resp := readControl(t, conn); !resp.OK || resp.ID != "1" {
+		t.Errorf("subscribe: %+v", resp)
+	}
+
+	// 实时消息也带有序号, 非 JSON 的数据编码为字符串
+	if err := server.GroupSend(websocket.TextMessage, []byte("live"), "replay"); err != nil {
+		t.Fatal(err)
+	}
+	expect(4, `"live"`)
+}
+
+func TestOfflineQueue(t *testing.T) {
+	server, url, codes := newNamedServer(t, DuplicateKick)
+	server.OfflineMaxLen = 2
+	server.OfflineTTL = time.Minute
+	// 补发的消息与实时消息一样经过中间件
+	server.Use(Middleware{Message: func(next MessageHandler) MessageHandler {
+		return func(messageType int, data []byte, from int, client *Client) {
+			next(messageType, append([]byte("server:"), data...), from, client)
+		}
+	}})
+	expired := make(chan []common.Message, 1)
+	server.OnOfflineExpire = func(channel string, messages []common.Message) {
+		expired <- messages
+	}
+	conn := dial(t, url)
+	waitCount(server, 1)
+	_ = conn.Close()
+	<-codes
+	waitCount(server, 0)
+
+	channel := server.Layer.NewChannel("alice")
+	for _, data := range []string{"1", "2", "3"} {
+		if err := server.Send(websocket.TextMessage, []byte(data), channel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case messages := <-expired:
+		if len(messages) != 1 || string(messages[0].Data) != "1" {
+			t.Errorf("expired: %+v", messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOfflineExpire not called")
+	}
+
+	conn = dial(t, url)
+	defer conn.Close()
+	for _, want := range []string{"server:2", "server:3"} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("offline message: got %q %v, want %q", data, err, want)
+		}
+	}
+}
+
+// newChannelCountLayer 记录 NewChannel 的调用次数
+type newChannelCountLayer struct {
+	*MemoryLayer
+	calls int
+}
+
+func (l *newChannelCountLayer) NewChannel(user string) string {
+	l.calls++
+	return l.MemoryLayer.NewChannel(user)
+}
+
+// TestIsLocal 本节点的名称只计算一次
+func TestIsLocal(t *testing.T) {
+	layer := &newChannelCountLayer{MemoryLayer: NewMemoryLayer(nil, nil)}
+	server := &Server{Layer: layer}
+	local := layer.MemoryLayer.NewChannel("alice")
+	for i := 0; i < 3; i++ {
+		if !server.isLocal(local) || server.isLocal("remote-node!alice") {
+			t.Fatal("wrong node")
+		}
+	}
+	if layer.calls != 1 {
+		t.Errorf("NewChannel called %d times", layer.calls)
+	}
+}
+
+// drainHookLayer 取出离线消息之后、返回之前调用 hook, 模拟补发期间到达的实时消息
+type drainHookLayer struct {
+	*MemoryLayer
+	hook func()
+}
+
+func (l *drainHookLayer) OfflineDrain(channel string, ttl time.Duration) ([]common.Message, []common.Message, error) {
+	messages, expired, err := l.MemoryLayer.OfflineDrain(channel, ttl)
+	if l.hook != nil {
+		l.hook()
+	}
+	return messages, expired, err
+}
+
+func TestOfflineDrainOrder(t *testing.T) {
+	server, url, codes := newNamedServer(t, DuplicateKick)
+	server.OfflineMaxLen = 10
+	server.OfflineTTL = time.Minute
+	layer := &drainHookLayer{MemoryLayer: server.Layer.(*MemoryLayer)}
+	server.Layer = layer
+	conn := dial(t, url)
+	waitCount(server, 1)
+	_ = conn.Close()
+	<-codes
+	waitCount(server, 0)
+
+	channel := server.Layer.NewChannel("alice")
+	for _, data := range []string{"1", "2"} {
+		if err := server.Send(websocket.TextMessage, []byte(data), channel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layer.hook = func() {
+		_ = server.Send(websocket.TextMessage, []byte("live"), channel)
+		// 等待 receiverLayerTask 处理这条实时消息
+		time.Sleep(100 * time.Millisecond)
+	}
+	conn = dial(t, url)
+	defer conn.Close()
+	for _, want := range []string{"1", "2", "live"} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("got %q %v, want %q", data, err, want)
+		}
+	}
+}
+
+// TestOfflineSweep 客户端一直不重新连接时, 离线消息过期后也会报告
+func TestOfflineSweep(t *testing.T) {
+	server, url, codes := newNamedServer(t, DuplicateKick)
+	server.OfflineMaxLen = 10
+	server.OfflineTTL = 300 * time.Millisecond
+	expired := make(chan []common.Message, 1)
+	server.OnOfflineExpire = func(channel string, messages []common.Message) {
+		expired <- messages
+	}
+	conn := dial(t, url)
+	waitCount(server, 1)
+	_ = conn.Close()
+	<-codes
+	waitCount(server, 0)
+
+	if err := server.Send(websocket.TextMessage, []byte("never read"), server.Layer.NewChannel("alice")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case messages := <-expired:
+		if len(messages) != 1 || string(messages[0].Data) != "never read" {
+			t.Errorf("expired: %+v", messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOfflineExpire not called")
+	}
+}
+
+func TestPresence(t *testing.T) {
+	server, url, codes := newNamedServer(t, DuplicateKick)
+	events := make(chan common.PresenceEvent, 10)
+	server.OnConnect = func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error) {
+		user := req.URL.Query().Get("user")
+		if next(user) == nil {
+			_ = client.Join("lobby", map[string]string{"name": user})
+		}
+	}
+	watcher := dial(t, strings.Replace(url, "alice", "bob", 1))
+	defer watcher.Close()
+	waitCount(server, 1)
+	go func() {
+		for {
+			var event common.PresenceEvent
+			if err := watcher.ReadJSON(&event); err != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+	expect := func(eventType, user string) {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if event.User == "bob" {
+					continue
+				}
+				if event.Type != eventType || event.User != user || event.Group != "lobby" || event.Meta["name"] != user {
+					t.Errorf("presence event: got %+v", event)
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s event", eventType)
+			}
+		}
+	}
+
+	conn := dial(t, url)
+	expect(common.PresenceJoin, "alice")
+	if presence, _ := server.Presence("lobby"); len(presence) != 2 {
+		t.Errorf("presence: got %+v", presence)
+	}
+	_ = conn.Close()
+	<-codes
+	expect(common.PresenceLeave, "alice")
+	if presence, _ := server.Presence("lobby"); len(presence) != 1 || presence[0].User != "bob" {
+		t.Errorf("presence after leave: got %+v", presence)
+	}
+}
+
+func TestRemoteCommand(t *testing.T) {
+	broker := NewMemoryBroker()
+	local, url := newBrokerServer(t, broker)
+	remote, _ := newBrokerServer(t, broker)
+	codes := make(chan int, 10)
+	local.OnDisconnect = func(code int, reason string, client *Client) {
+		codes <- code
+	}
+	local.OnRefreshAuth = func(client *Client, data []byte) error {
+		if string(data) != "valid" {
+			return ErrForbidden
+		}
+		return nil
+	}
+	local.OnConnect = func(resp http.ResponseWriter, req *http.Request, client *Client, next func(channelName string) error) {
+		if next(req.URL.Query().Get("user")) == nil {
+			_ = client.Join("room", nil)
+		}
+	}
+	channel := func(user string) string {
+		return local.Layer.NewChannel(user)
+	}
+	expectClosed := func(conn *websocket.Conn, code int) {
+		t.Helper()
+		select {
+		case got := <-codes:
+			if got != code {
+				t.Errorf("close code %d, want %d", got, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("client not closed")
+		}
+		_ = conn.Close()
+	}
+
+	alice := dial(t, url+"?user=alice")
+	waitCount(local, 1)
+	if err := remote.CloseChannel(4100, "kicked", channel("alice")); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(alice, 4100)
+
+	bob := dial(t, url+"?user=bob")
+	waitCount(local, 1)
+	if err := remote.ForceLeave(channel("bob"), "room"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		presence, _ := remote.Presence("room")
+		channels, _ := remote.Layer.GetChannels("room")
+		if len(presence) == 0 && len(channels) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("force leave: presence %v, channels %v", presence, channels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := remote.RefreshAuth([]byte("valid"), channel("bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.RefreshAuth([]byte("expired"), channel("bob")); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(bob, CloseAuthFailed)
+
+	carol := dial(t, url+"?user=carol")
+	dave := dial(t, url+"?user=dave")
+	waitCount(local, 2)
+	if err := remote.CloseGroup(4101, "room closed", "room"); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(carol, 4101)
+	expectClosed(dave, 4101)
+}
+
+// TestRemoteGroupAdd 在其他节点上把 channel 加入 group 后, channel 所在的节点能展开 group 消息
+func TestRemoteGroupAdd(t *testing.T) {
+	broker := NewMemoryBroker()
+	local, url := newBrokerServer(t, broker)
+	remote, _ := newBrokerServer(t, broker)
+	conn := dial(t, url)
+	defer conn.Close()
+	waitCount(local, 1)
+	var channel string
+	local.Clients.Range(func(client *Client) bool {
+		channel = client.Channel
+		return false
+	})
+	expect := func(data string) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, message, err := conn.ReadMessage()
+		if err != nil || string(message) != data {
+			t.Fatalf("got %q %v, want %q", message, err, data)
+		}
+	}
+
+	if err := remote.GroupAdd(channel, "news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.GroupSend(websocket.TextMessage, []byte("hello"), "news"); err != nil {
+		t.Fatal(err)
+	}
+	expect("hello")
+
+	if err := remote.GroupDiscard(channel, "news"); err != nil {
+		t.Fatal(err)
+	}
+	_ = remote.GroupSend(websocket.TextMessage, []byte("gone"), "news")
+	_ = remote.GroupSend(websocket.TextMessage, []byte("after"), "all")
+	expect("after")
+}
+
+func TestMetrics(t *testing.T) {
+	server, url := newTestServer(t)
+	registry := metrics.NewRegistry()
+	server.SetMetrics(registry)
+
+	conn := dial(t, url)
+	defer conn.Close()
+	waitCount(server, 1)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"ws_connections 1",
+		"ws_connections_total 1",
+		"ws_messages_received_total 1",
+		"ws_messages_sent_total 1",
+		"ws_layer_messages_total 1",
+		"ws_layer_queue_depth 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+// TestConfigMetrics Config.Metrics 在 NewServer 中设置, SetMetrics(nil) 不再收集
+func TestConfigMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := metrics.NewRegistry()
+	server := NewServer(&config.Config{Layer: config.MemoryLayer, Metrics: registry}, ctx, nil, nil, nil)
+	if server.metrics != registry {
+		t.Errorf("metrics %v, want the configured registry", server.metrics)
+	}
+	server.SetMetrics(nil)
+	if server.metrics != metrics.Discard {
+		t.Errorf("metrics %v, want metrics.Discard", server.metrics)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	server, url := newTestServer(t)
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+	disconnected := make(chan interface{}, 1)
+	rejected := make(chan *Client, 1)
+	// 处理函数只组合一次
+	var composed int32
+	server.Use(Middleware{
+		Connect: func(next ConnectHandler) ConnectHandler {
+			return func(resp http.ResponseWriter, req *http.Request, client *Client, n func(string) error) {
+				record("auth")
+				if req.URL.Query().Get("token") != "ok" {
+					rejected <- client
+					http.Error(resp, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				client.Set("user", "alice")
+				next(resp, req, client, n)
+			}
+		},
+		Disconnect: func(next DisconnectHandler) DisconnectHandler {
+			return func(code int, reason string, client *Client) {
+				user, _ := client.Get("user")
+				disconnected <- user
+				next(code, reason, client)
+			}
+		},
+	}, Middleware{
+		Connect: func(next ConnectHandler) ConnectHandler {
+			return func(resp http.ResponseWriter, req *http.Request, client *Client, n func(string) error) {
+				record("log")
+				next(resp, req, client, n)
+			}
+		},
+		Message: func(next MessageHandler) MessageHandler {
+			atomic.AddInt32(&composed, 1)
+			return func(messageType int, data []byte, from int, client *Client) {
+				if from == FromLocal {
+					if string(data) == "secret" {
+						return
+					}
+					data = []byte(strings.ToUpper(string(data)))
+				}
+				next(messageType, data, from, client)
+			}
+		},
+	})
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("connection without token: %v", err)
+	}
+	// 被拒绝的连接的 ctx 随之释放
+	client := <-rejected
+	for deadline := time.Now().Add(5 * time.Second); client.ctx.Err() == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.ctx.Err() == nil {
+		t.Error("rejected client context not cancelled")
+	}
+	conn := dial(t, url+"?token=ok")
+	waitCount(server, 1)
+	for _, text := range []string{"secret", "hello"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "HELLO" {
+		t.Errorf("got %q %v", data, err)
+	}
+
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	select {
+	case user := <-disconnected:
+		if user != "alice" {
+			t.Errorf("client value in disconnect: %v", user)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnect middleware not called")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(order, ",") != "auth,auth,log" {
+		t.Errorf("connect order: %v", order)
+	}
+	if n := atomic.LoadInt32(&composed); n != 1 {
+		t.Errorf("message middleware composed %d times", n)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	server, url := newTestServer(t)
+	auth := NewHMACAuthenticator([]byte("secret"))
+	server.Authenticator = auth
+
+	forged, _ := NewHMACAuthenticator([]byte("other")).Sign(Claims{Subject: "alice"})
+	for _, target := range []string{url, url + "?token=" + forged} {
+		if _, resp, err := websocket.DefaultDialer.Dial(target, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %v", target, err)
+		}
+	}
+
+	token, err := auth.Sign(Claims{Subject: "alice", Extra: map[string]string{"role": "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Sec-Websocket-Protocol": {"access_token, " + token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if protocol := resp.Header.Get("Sec-Websocket-Protocol"); protocol != "access_token" {
+		t.Errorf("subprotocol: %q", protocol)
+	}
+	waitCount(server, 1)
+	server.Clients.Range(func(client *Client) bool {
+		if claims := client.Claims(); claims == nil || claims.Subject != "alice" || claims.Extra["role"] != "admin" {
+			t.Errorf("claims: %+v", claims)
+		}
+		return true
+	})
+
+	// 令牌到期后断开连接
+	token, _ = auth.Sign(Claims{Subject: "bob", ExpiresAt: time.Now().Add(2 * time.Second).Unix()})
+	expiring := dial(t, url+"?token="+token)
+	defer expiring.Close()
+	_ = expiring.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := expiring.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, CloseTokenExpired) {
+				t.Errorf("expected token expired close, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestAllowOrigins(t *testing.T) {
+	check := AllowOrigins("https://example.com", "https://*.example.org")
+	for origin, allowed := range map[string]bool{
+		"":                        true,
+		"https://example.com":     true,
+		"https://EXAMPLE.com":     true,
+		"http://example.com":      false,
+		"https://evil.com":        false,
+		"https://a.example.org":   true,
+		"https://example.org":     false,
+		"https://a.example.org.x": false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if check(req) != allowed {
+			t.Errorf("%q: expected %v", origin, allowed)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server, url := newTestServer(t)
+	server.ControlProtocol = true
+	server.MessageRateLimit = RateLimit{Rate: 0.01, Burst: 2, Action: RateLimitWarn}
+	server.ConnectionRateLimit = RateLimit{Rate: 0.01, Burst: 2}
+
+	conn := dial(t, url)
+	defer conn.Close()
+	// 超过限制的两条消息只警告一次
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	echoes, warnings := 0, 0
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for echoes+warnings < 3 {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) == "hi" {
+			echoes++
+		} else if string(data) == `{"type":"rate_limited","ok":false,"error":"rate limit exceeded","code":4005}` {
+			warnings++
+		} else {
+			t.Fatalf("unexpected message %q", data)
+		}
+	}
+	if echoes != 2 || warnings != 1 {
+		t.Errorf("echoes %d, warnings %d", echoes, warnings)
+	}
+	for deadline := time.Now().Add(5 * time.Second); server.RateLimited() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Errorf("unexpected message %q", data)
+	}
+
+	// 同一个 IP 的第三个连接被拒绝, 发布超过限制时断开连接
+	server.MessageRateLimit = RateLimit{}
+	server.PublishRateLimit = RateLimit{Rate: 0.01, Burst: 1, Action: RateLimitDisconnect}
+	publisher := dial(t, url)
+	defer publisher.Close()
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_ = publisher.WriteMessage(websocket.TextMessage, []byte("hi"))
+	}
+	_ = publisher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := publisher.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, CloseRateLimited) {
+				t.Errorf("expected rate limited close, got %v", err)
+			}
+			break
+		}
+	}
+	if limited := server.RateLimited(); limited != 4 {
+		t.Errorf("rate limited: %d", limited)
+	}
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"time"
+)
+
+func (s *Server) isClosing() bool {
+	return atomic.LoadInt32(&s.closing) == 1
+}
+
+// Shutdown 优雅地停止服务: 不再接受新连接, 把本节点的 channel 从所有 group 中移除,
+// 发送完每个客户端队列中的消息后以 CloseGoingAway 断开, 最后等待 layer 的任务退出.
+// ctx 结束时强制断开剩余的客户端并返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.closing, 1)
+
+	var firstErr error
+	for channel, groups := range s.localLayer.entries() {
+		// 其他节点的 channel 由它们自己的节点负责移除
+		if !s.isLocal(channel) {
+			continue
+		}
+		if err := s.Layer.GroupDiscard(channel, groups...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.localLayer.discard(channel, groups...)
+	}
+
+	s.Clients.Range(func(client *Client) bool {
+		client.goAway()
+		return true
+	})
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.Clients.Count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.Clients.Range(func(client *Client) bool {
+				client.finish(websocket.CloseGoingAway, "server shutdown")
+				return true
+			})
+			s.cancel()
+			return ctx.Err()
+		}
+	}
+
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		s.Layer.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return firstErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
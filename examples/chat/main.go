@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"ws-channels/config"
 	"ws-channels/core"
@@ -45,5 +48,17 @@ func main() {
 	server.Run()
 
 	http.HandleFunc("/ws", server.Handler)
-	_ = http.ListenAndServe("0.0.0.0:7777", nil)
+	httpServer := &http.Server{Addr: "0.0.0.0:7777"}
+	go func() {
+		_ = httpServer.ListenAndServe()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 先断开 websocket 连接, hijack 后的连接不受 http.Server.Shutdown 管理
+	_ = server.Shutdown(ctx)
+	_ = httpServer.Shutdown(ctx)
 }
@@ -0,0 +1,586 @@
+// Package layertest 提供 common.LayerInterface 的通用行为测试, 每个 layer 实现都应该通过这套测试
+package layertest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"ws-channels/common"
+)
+
+// Factory 每次调用都创建一个新节点, 同一个 Suite 创建的节点必须共享同一个后端
+type Factory func(receiverMessage chan common.ReceiverLayerMessage) common.LayerInterface
+
+type Suite struct {
+	New Factory
+	// SetExpiry 修改节点的 group 过期时间, 为 nil 时跳过过期测试
+	SetExpiry func(layer common.LayerInterface, expiry time.Duration)
+	// SetHistory 开启节点的 group 历史, 为 nil 时跳过历史测试
+	SetHistory func(layer common.LayerInterface, size int, ttl time.Duration)
+	// SetNodeLease 缩短节点租约以便测试失效节点的清理, 为 nil 时使用默认值
+	SetNodeLease func(layer common.LayerInterface, lease time.Duration)
+	// ShutdownTimeout ctx 取消后节点停止接收消息所需的最长时间
+	ShutdownTimeout time.Duration
+}
+
+type node struct {
+	layer    common.LayerInterface
+	receiver chan common.ReceiverLayerMessage
+	cancel   context.CancelFunc
+}
+
+// newNode 创建并启动一个节点, configure 在 Run 之前调用
+func (s Suite) newNode(t *testing.T, configure ...func(layer common.LayerInterface)) *node {
+	receiver := make(chan common.ReceiverLayerMessage, 1000)
+	layer := s.New(receiver)
+	for _, f := range configure {
+		f(layer)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := layer.Run(ctx); err != nil {
+		cancel()
+		t.Fatal("run layer:", err)
+	}
+	n := &node{layer: layer, receiver: receiver, cancel: cancel}
+	t.Cleanup(cancel)
+	return n
+}
+
+func (s Suite) Run(t *testing.T) {
+	t.Run("GroupAddDiscard", s.testGroupAddDiscard)
+	t.Run("GroupUnion", s.testGroupUnion)
+	t.Run("Send", s.testSend)
+	t.Run("CrossNode", s.testCrossNode)
+	t.Run("RemoteGroupAdd", s.testRemoteGroupAdd)
+	t.Run("Users", s.testUsers)
+	t.Run("Expiry", s.testExpiry)
+	t.Run("History", s.testHistory)
+	t.Run("Offline", s.testOffline)
+	t.Run("Presence", s.testPresence)
+	t.Run("Nodes", s.testNodes)
+	t.Run("ConcurrentSend", s.testConcurrentSend)
+	t.Run("Shutdown", s.testShutdown)
+}
+
+// groupName 生成本次测试独占的 group 名称, 避免共享后端上的残留数据互相影响
+func groupName(name string) string {
+	return "layertest:" + common.RandomString(8) + ":" + name
+}
+
+func textMessage(data string) common.Message {
+	return common.Message{MessageType: 1, Data: []byte(data)}
+}
+
+// receive 等待 n 条消息, 超时返回已收到的消息
+func receive(receiver chan common.ReceiverLayerMessage, n int, timeout time.Duration) []common.ReceiverLayerMessage {
+	result := make([]common.ReceiverLayerMessage, 0, n)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(result) < n {
+		select {
+		case msg := <-receiver:
+			result = append(result, msg)
+		case <-timer.C:
+			return result
+		}
+	}
+	return result
+}
+
+// expectNothing 在 wait 时间内不应该收到任何消息
+func expectNothing(t *testing.T, receiver chan common.ReceiverLayerMessage, wait time.Duration) {
+	t.Helper()
+	if msgs := receive(receiver, 1, wait); len(msgs) > 0 {
+		t.Errorf("unexpected message: %+v", msgs[0])
+	}
+}
+
+// expectGroupMessage group 消息每个节点只投递一次, 并且携带 group 而不是展开后的 channel
+func expectGroupMessage(t *testing.T, receiver chan common.ReceiverLayerMessage, data string, groups ...string) {
+	t.Helper()
+	msgs := receive(receiver, 1, 5*time.Second)
+	if len(msgs) != 1 {
+		t.Fatalf("group message not received")
+	}
+	msg := msgs[0]
+	if string(msg.Message.Data) != data || len(msg.Channels) != 0 || !equal(sorted(msg.Groups...), sorted(groups...)) {
+		t.Errorf("group message: got %+v", msg)
+	}
+	expectNothing(t, receiver, 200*time.Millisecond)
+}
+
+func sorted(values ...string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+	return result
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Suite) expectChannels(t *testing.T, layer common.LayerInterface, group string, expected ...string) {
+	t.Helper()
+	channels, err := layer.GetChannels(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(sorted(channels...), sorted(expected...)) {
+		t.Errorf("group %s: got %v, want %v", group, channels, expected)
+	}
+}
+
+func (s Suite) testGroupAddDiscard(t *testing.T) {
+	n := s.newNode(t)
+	groups := []string{groupName("a"), groupName("b"), groupName("c")}
+	channels := []string{n.layer.NewChannel(""), n.layer.NewChannel(""), n.layer.NewChannel("")}
+
+	if err := n.layer.GroupAdd(channels[0], groups...); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.layer.GroupAdd(channels[1], groups[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.layer.GroupAdd(channels[2], groups[2]); err != nil {
+		t.Fatal(err)
+	}
+	s.expectChannels(t, n.layer, groups[0], channels[0], channels[1])
+	s.expectChannels(t, n.layer, groups[1], channels[0])
+	s.expectChannels(t, n.layer, groups[2], channels[0], channels[2])
+
+	if err := n.layer.GroupDiscard(channels[0], groups...); err != nil {
+		t.Fatal(err)
+	}
+	s.expectChannels(t, n.layer, groups[0], channels[1])
+	s.expectChannels(t, n.layer, groups[1])
+
+	if err := n.layer.GroupDiscard(channels[1], groups[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.layer.GroupDiscard(channels[2], groups[2]); err != nil {
+		t.Fatal(err)
+	}
+	s.expectChannels(t, n.layer, groups[0])
+	s.expectChannels(t, n.layer, groups[2])
+}
+
+func (s Suite) testGroupUnion(t *testing.T) {
+	n := s.newNode(t)
+	groups := []string{groupName("a"), groupName("b")}
+	both := n.layer.NewChannel("")
+	onlyA := n.layer.NewChannel("")
+	onlyB := n.layer.NewChannel("")
+	_ = n.layer.GroupAdd(both, groups...)
+	_ = n.layer.GroupAdd(onlyA, groups[0])
+	_ = n.layer.GroupAdd(onlyB, groups[1])
+
+	if err := n.layer.GroupSend(textMessage("union"), groups...); err != nil {
+		t.Fatal(err)
+	}
+	expectGroupMessage(t, n.receiver, "union", groups...)
+}
+
+func (s Suite) testSend(t *testing.T) {
+	n := s.newNode(t)
+	channel := n.layer.NewChannel("")
+	if err := n.layer.Send(textMessage("single"), channel); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receive(n.receiver, 1, 5*time.Second)
+	if len(msgs) != 1 || string(msgs[0].Message.Data) != "single" || !equal(msgs[0].Channels, []string{channel}) {
+		t.Errorf("send: got %+v", msgs)
+	}
+}
+
+func (s Suite) testCrossNode(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	idle := s.newNode(t)
+	group := groupName("cross")
+	channelA := a.layer.NewChannel("")
+	channelB := b.layer.NewChannel("")
+	_ = a.layer.GroupAdd(channelA, group)
+	_ = b.layer.GroupAdd(channelB, group)
+
+	if err := a.layer.Send(textMessage("to b"), channelB); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receive(b.receiver, 1, 5*time.Second)
+	if len(msgs) != 1 || string(msgs[0].Message.Data) != "to b" {
+		t.Fatalf("cross node send: got %+v", msgs)
+	}
+	expectNothing(t, a.receiver, 200*time.Millisecond)
+
+	if err := b.layer.GroupSend(textMessage("group"), group); err != nil {
+		t.Fatal(err)
+	}
+	expectGroupMessage(t, a.receiver, "group", group)
+	expectGroupMessage(t, b.receiver, "group", group)
+	// 没有成员的节点不会收到 group 消息
+	expectNothing(t, idle.receiver, 200*time.Millisecond)
+}
+
+// testRemoteGroupAdd 一个节点把另一个节点上的 channel 加入 group, group 消息投递到 channel 所在的节点
+func (s Suite) testRemoteGroupAdd(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	group := groupName("remote")
+	channelA := a.layer.NewChannel("")
+	if err := b.layer.GroupAdd(channelA, group); err != nil {
+		t.Fatal(err)
+	}
+	s.expectChannels(t, a.layer, group, channelA)
+
+	if err := b.layer.GroupSend(textMessage("remote"), group); err != nil {
+		t.Fatal(err)
+	}
+	expectGroupMessage(t, a.receiver, "remote", group)
+	expectNothing(t, b.receiver, 200*time.Millisecond)
+
+	if err := b.layer.GroupDiscard(channelA, group); err != nil {
+		t.Fatal(err)
+	}
+	s.expectChannels(t, a.layer, group)
+	if err := b.layer.GroupSend(textMessage("discarded"), group); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, a.receiver, 200*time.Millisecond)
+}
+
+func (s Suite) testUsers(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	user := groupName("user")
+	phone := a.layer.NewChannel("phone")
+	laptop := b.layer.NewChannel("laptop")
+	if err := a.layer.UserAdd(user, phone); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.layer.UserAdd(user, laptop); err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range []common.LayerInterface{a.layer, b.layer} {
+		channels, err := layer.GetUserChannels(user)
+		if err != nil || !equal(sorted(channels...), sorted(phone, laptop)) {
+			t.Errorf("user channels: got %v %v", channels, err)
+		}
+	}
+	if err := a.layer.UserDiscard(user, phone); err != nil {
+		t.Fatal(err)
+	}
+	if channels, _ := b.layer.GetUserChannels(user); !equal(channels, []string{laptop}) {
+		t.Errorf("after discard: got %v", channels)
+	}
+}
+
+func (s Suite) testExpiry(t *testing.T) {
+	if s.SetExpiry == nil {
+		t.Skip("layer does not support expiry")
+	}
+	n := s.newNode(t, func(layer common.LayerInterface) {
+		s.SetExpiry(layer, time.Second)
+	})
+	group := groupName("expiry")
+	channel := n.layer.NewChannel("")
+	if err := n.layer.GroupAdd(channel, group); err != nil {
+		t.Fatal(err)
+	}
+	s.expectChannels(t, n.layer, group, channel)
+	time.Sleep(2100 * time.Millisecond)
+	s.expectChannels(t, n.layer, group)
+}
+
+// history 等待 group 的历史达到 n 条, GroupSend 可能是异步写入历史的
+func history(t *testing.T, layer common.LayerInterface, group string, since uint64, n int) []common.HistoryMessage {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages, err := layer.GroupHistory(group, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) >= n || time.Now().After(deadline) {
+			return messages
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (s Suite) testHistory(t *testing.T) {
+	if s.SetHistory == nil {
+		t.Skip("layer does not support history")
+	}
+	a := s.newNode(t, func(layer common.LayerInterface) {
+		s.SetHistory(layer, 3, 0)
+	})
+	b := s.newNode(t, func(layer common.LayerInterface) {
+		s.SetHistory(layer, 3, 0)
+	})
+	group := groupName("history")
+	for i := 0; i < 5; i++ {
+		if err := a.layer.GroupSend(textMessage(fmt.Sprint(i)), group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 序号是原子分配的, 读到序号 5 说明 5 条消息都已写入
+	if messages := history(t, b.layer, group, 4, 1); len(messages) != 1 || messages[0].Seq != 5 {
+		t.Fatalf("history since 4: got %+v", messages)
+	}
+	// 没有成员的 group 也保留历史, 其他节点可以读取
+	messages, err := b.layer.GroupHistory(group, 0)
+	if err != nil || len(messages) != 3 {
+		t.Fatalf("history: got %d messages, want 3 (%v)", len(messages), err)
+	}
+	for i, message := range messages {
+		if message.Seq != uint64(i+3) {
+			t.Errorf("history %d: got seq %d, want %d", i, message.Seq, i+3)
+		}
+	}
+	if messages, _ := b.layer.GroupHistory(group, 5); len(messages) != 0 {
+		t.Errorf("history since 5: got %+v", messages)
+	}
+
+	// 实时投递的 group 消息带有与历史一致的序号, 客户端据此在重连后补发
+	group = groupName("history-seq")
+	_ = b.layer.GroupAdd(b.layer.NewChannel(""), group)
+	for i := 0; i < 2; i++ {
+		if err := a.layer.GroupSend(textMessage("seq"), group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seqs := make([]uint64, 0, 2)
+	for _, msg := range receive(b.receiver, 2, 5*time.Second) {
+		if len(msg.Seq) != 1 {
+			t.Fatalf("group message without seq: %+v", msg)
+		}
+		seqs = append(seqs, msg.Seq[0])
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("group message seq: got %v, want [1 2]", seqs)
+	}
+
+	ttl := s.newNode(t, func(layer common.LayerInterface) {
+		s.SetHistory(layer, 0, time.Second)
+	})
+	group = groupName("history-ttl")
+	_ = ttl.layer.GroupSend(textMessage("expire"), group)
+	if messages := history(t, ttl.layer, group, 0, 1); len(messages) != 1 {
+		t.Fatalf("history ttl: got %d messages, want 1", len(messages))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if messages, _ := ttl.layer.GroupHistory(group, 0); len(messages) != 0 {
+		t.Errorf("history ttl: expired messages returned %+v", messages)
+	}
+}
+
+func messagesData(messages []common.Message) []string {
+	result := make([]string, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, string(message.Data))
+	}
+	return result
+}
+
+func (s Suite) testOffline(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	channel := groupName("offline")
+	for i, data := range []string{"1", "2", "3"} {
+		dropped, err := a.layer.OfflinePush(channel, textMessage(data), 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[int][]string{2: {"1"}}[i]; !equal(messagesData(dropped), want) {
+			t.Errorf("push %s: dropped %v, want %v", data, messagesData(dropped), want)
+		}
+	}
+	// 其他节点也可以取出, 取出后队列被清空
+	messages, expired, err := b.layer.OfflineDrain(channel, time.Minute)
+	if err != nil || !equal(messagesData(messages), []string{"2", "3"}) || len(expired) != 0 {
+		t.Errorf("drain: got %v, expired %v, %v", messagesData(messages), messagesData(expired), err)
+	}
+	if messages, _, _ := b.layer.OfflineDrain(channel, time.Minute); len(messages) != 0 {
+		t.Errorf("drain twice: got %v", messagesData(messages))
+	}
+
+	ttl := 500 * time.Millisecond
+	_, _ = a.layer.OfflinePush(channel, textMessage("old"), 10, ttl)
+	time.Sleep(ttl + 100*time.Millisecond)
+	_, _ = a.layer.OfflinePush(channel, textMessage("new"), 10, time.Minute)
+	messages, expired, err = a.layer.OfflineDrain(channel, ttl)
+	if err != nil || !equal(messagesData(messages), []string{"new"}) || !equal(messagesData(expired), []string{"old"}) {
+		t.Errorf("drain with ttl: got %v, expired %v, %v", messagesData(messages), messagesData(expired), err)
+	}
+
+	// 写入时也返回已经超过 ttl 的消息, 客户端不重新连接也能报告
+	_, _ = a.layer.OfflinePush(channel, textMessage("stale"), 10, ttl)
+	time.Sleep(ttl + 100*time.Millisecond)
+	dropped, err := a.layer.OfflinePush(channel, textMessage("fresh"), 10, ttl)
+	if err != nil || !equal(messagesData(dropped), []string{"stale"}) {
+		t.Errorf("push with ttl: dropped %v, %v", messagesData(dropped), err)
+	}
+	messages, expired, err = a.layer.OfflineDrain(channel, ttl)
+	if err != nil || !equal(messagesData(messages), []string{"fresh"}) || len(expired) != 0 {
+		t.Errorf("drain after prune: got %v, expired %v, %v", messagesData(messages), messagesData(expired), err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Suite) testNodes(t *testing.T) {
+	lease := func(layer common.LayerInterface) {
+		if s.SetNodeLease != nil {
+			s.SetNodeLease(layer, time.Second)
+		}
+	}
+	a := s.newNode(t, lease)
+	b := s.newNode(t, lease)
+	nodeOf := func(layer common.LayerInterface) string {
+		return strings.SplitN(layer.NewChannel(""), "!", 2)[0]
+	}
+	nodeB := nodeOf(b.layer)
+	nodes, err := a.layer.Nodes()
+	if err != nil || !contains(nodes, nodeOf(a.layer)) || !contains(nodes, nodeB) {
+		t.Fatalf("nodes: got %v %v", nodes, err)
+	}
+
+	group := groupName("nodes")
+	user := groupName("user")
+	channelA := a.layer.NewChannel("")
+	channelB := b.layer.NewChannel("")
+	_ = a.layer.GroupAdd(channelA, group)
+	_ = b.layer.GroupAdd(channelB, group)
+	_ = b.layer.UserAdd(user, channelB)
+	_ = b.layer.PresenceAdd(group, common.PresenceInfo{Channel: channelB})
+
+	// 停止的节点在租约过期后被其他节点清理
+	b.cancel()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		nodes, _ = a.layer.Nodes()
+		channels, _ := a.layer.GetChannels(group)
+		users, _ := a.layer.GetUserChannels(user)
+		presence, _ := a.layer.Presence(group)
+		if !contains(nodes, nodeB) && equal(channels, []string{channelA}) && len(users) == 0 && len(presence) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dead node not cleaned: nodes %v, channels %v, users %v, presence %v", nodes, channels, users, presence)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	msgs := receive(a.receiver, 1, 5*time.Second)
+	var event common.PresenceEvent
+	if len(msgs) != 1 || json.Unmarshal(msgs[0].Message.Data, &event) != nil ||
+		event.Type != common.PresenceLeave || event.Channel != channelB {
+		t.Errorf("leave event for dead node: got %+v", msgs)
+	}
+}
+
+func (s Suite) testPresence(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	group := groupName("presence")
+	channelA := a.layer.NewChannel("alice")
+	channelB := b.layer.NewChannel("bob")
+	joined := time.Now().Truncate(time.Second)
+	if err := a.layer.PresenceAdd(group, common.PresenceInfo{Channel: channelA, User: "alice", JoinedAt: joined, Meta: map[string]string{"status": "away"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.layer.PresenceAdd(group, common.PresenceInfo{Channel: channelB, User: "bob", JoinedAt: joined}); err != nil {
+		t.Fatal(err)
+	}
+	presence, err := b.layer.Presence(group)
+	if err != nil || len(presence) != 2 {
+		t.Fatalf("presence: got %+v %v", presence, err)
+	}
+	for _, info := range presence {
+		if info.Channel == channelA && (info.User != "alice" || !info.JoinedAt.Equal(joined) || info.Meta["status"] != "away") {
+			t.Errorf("presence info: got %+v", info)
+		}
+	}
+	if err := a.layer.PresenceDiscard(group, channelA); err != nil {
+		t.Fatal(err)
+	}
+	if presence, _ := a.layer.Presence(group); len(presence) != 1 || presence[0].Channel != channelB {
+		t.Errorf("after discard: got %+v", presence)
+	}
+}
+
+func (s Suite) testConcurrentSend(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	channel := b.layer.NewChannel("")
+	const senders, perSender = 10, 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				if err := a.layer.Send(textMessage(fmt.Sprintf("%d-%d", i, j)), channel); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	msgs := receive(b.receiver, senders*perSender, 10*time.Second)
+	seen := make(map[string]bool)
+	for _, msg := range msgs {
+		seen[string(msg.Message.Data)] = true
+	}
+	if len(msgs) != senders*perSender || len(seen) != senders*perSender {
+		t.Errorf("concurrent send: got %d messages, %d distinct", len(msgs), len(seen))
+	}
+}
+
+func (s Suite) testShutdown(t *testing.T) {
+	a := s.newNode(t)
+	b := s.newNode(t)
+	channel := b.layer.NewChannel("")
+
+	b.cancel()
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	done := make(chan struct{})
+	go func() {
+		b.layer.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Wait did not return after ctx was cancelled")
+	}
+
+	if err := a.layer.Send(textMessage("after shutdown"), channel); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, b.receiver, 500*time.Millisecond)
+}
@@ -0,0 +1,280 @@
+package redis
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSlots     = 16384
+	clusterRedirects = 5
+	clusterRetryWait = 100 * time.Millisecond
+)
+
+var errClusterUnavailable = errors.New("redis cluster: no reachable node")
+
+// clusterPool 按 slot 把命令路由到对应节点的连接池, 并处理 MOVED 和 ASK 重定向
+type clusterPool struct {
+	seeds   []string
+	newPool func(addr string) *redis.Pool
+
+	mu    sync.RWMutex
+	slots [clusterSlots]string
+	pools map[string]*redis.Pool
+}
+
+func newClusterPool(seeds []string, newPool func(addr string) *redis.Pool) *clusterPool {
+	c := &clusterPool{
+		seeds:   seeds,
+		newPool: newPool,
+		pools:   make(map[string]*redis.Pool),
+	}
+	// 失败时先使用种子节点, 由 MOVED 重定向更新 slot; 集群不可用时 Run 的第一条命令会返回错误
+	_ = c.refresh()
+	return c
+}
+
+func (c *clusterPool) Get() redis.Conn {
+	return &routedConn{router: c}
+}
+
+func (c *clusterPool) pool(addr string) *redis.Pool {
+	c.mu.RLock()
+	pool, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return pool
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok = c.pools[addr]; !ok {
+		pool = c.newPool(addr)
+		c.pools[addr] = pool
+	}
+	return pool
+}
+
+// addrs 已知的所有节点, 种子节点排在最后
+func (c *clusterPool) addrs() []string {
+	c.mu.RLock()
+	result := make([]string, 0, len(c.pools)+len(c.seeds))
+	for addr := range c.pools {
+		result = append(result, addr)
+	}
+	c.mu.RUnlock()
+	return append(result, c.seeds...)
+}
+
+// dial 建立一个不属于连接池的连接, pub/sub 的消息会在整个集群中传播, 连接任意节点即可
+func (c *clusterPool) dial() (redis.Conn, error) {
+	err := errClusterUnavailable
+	for _, addr := range c.addrs() {
+		var conn redis.Conn
+		if conn, err = c.pool(addr).Dial(); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// refresh 通过 CLUSTER SLOTS 重新加载 slot 与节点的对应关系
+func (c *clusterPool) refresh() error {
+	err := errClusterUnavailable
+	for _, addr := range c.addrs() {
+		var slots map[int]string
+		if slots, err = c.loadSlots(addr); err == nil {
+			c.mu.Lock()
+			for slot, owner := range slots {
+				c.slots[slot] = owner
+			}
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *clusterPool) loadSlots(addr string) (map[int]string, error) {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	result := make(map[int]string)
+	for _, r := range ranges {
+		values, err := redis.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			continue
+		}
+		start, _ := redis.Int(values[0], nil)
+		end, _ := redis.Int(values[1], nil)
+		master, err := redis.Values(values[2], nil)
+		if err != nil || len(master) < 2 {
+			continue
+		}
+		ip, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		// 节点没有配置地址时返回空字符串, 表示与当前连接的节点相同
+		if ip == "" {
+			ip = host
+		}
+		owner := net.JoinHostPort(ip, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			result[slot] = owner
+		}
+	}
+	return result, nil
+}
+
+// addr 返回 key 所在的节点, 没有 key 或还不知道 slot 时使用任意节点
+func (c *clusterPool) addr(key string, hasKey bool) string {
+	if hasKey {
+		c.mu.RLock()
+		addr := c.slots[keySlot(key)]
+		c.mu.RUnlock()
+		if addr != "" {
+			return addr
+		}
+	}
+	return c.addrs()[0]
+}
+
+func (c *clusterPool) moved(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots[slot] = addr
+}
+
+// redirect 解析 MOVED 和 ASK 错误, 例如 "MOVED 3999 127.0.0.1:6381"
+func redirect(err error) (kind string, slot int, addr string, ok bool) {
+	redisErr, isRedisErr := err.(redis.Error)
+	if !isRedisErr {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+// retryable 集群正在迁移或选举时可以稍后重试的错误
+func retryable(err error) bool {
+	redisErr, ok := err.(redis.Error)
+	return ok && (strings.HasPrefix(string(redisErr), "TRYAGAIN") || strings.HasPrefix(string(redisErr), "CLUSTERDOWN"))
+}
+
+// do 执行单条命令, 跟随 MOVED 和 ASK 重定向
+func (c *clusterPool) do(command routedCommand) (interface{}, error) {
+	key, hasKey := commandKey(command.name, command.args)
+	addr := c.addr(key, hasKey)
+	asking := false
+	var err error
+	for i := 0; i < clusterRedirects; i++ {
+		conn := c.pool(addr).Get()
+		if asking {
+			_ = conn.Send("ASKING")
+		}
+		var reply interface{}
+		reply, err = conn.Do(command.name, command.args...)
+		conn.Close()
+
+		if kind, slot, target, ok := redirect(err); ok {
+			if kind == "MOVED" {
+				c.moved(slot, target)
+			}
+			addr, asking = target, kind == "ASK"
+			continue
+		}
+		if retryable(err) {
+			time.Sleep(clusterRetryWait)
+			continue
+		}
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			// 连接失败时节点可能已经下线, 重新加载 slot 后再试一次
+			if c.refresh() == nil && c.addr(key, hasKey) != addr {
+				addr, asking = c.addr(key, hasKey), false
+				continue
+			}
+		}
+		return reply, err
+	}
+	return nil, err
+}
+
+// transaction 在同一个连接上执行 MULTI ... EXEC, 按事务中第一个 key 路由
+func (c *clusterPool) transaction(commands []routedCommand) (interface{}, error) {
+	key, hasKey := "", false
+	for _, command := range commands {
+		if key, hasKey = commandKey(command.name, command.args); hasKey {
+			break
+		}
+	}
+	addr := c.addr(key, hasKey)
+	var err error
+	for i := 0; i < clusterRedirects; i++ {
+		conn := c.pool(addr).Get()
+		for _, command := range commands {
+			_ = conn.Send(command.name, command.args...)
+		}
+		if err = conn.Flush(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// 入队的回复中出现重定向时 EXEC 会失败, 更新 slot 后重试整个事务
+		var reply interface{}
+		var moved error
+		for range commands {
+			var e error
+			reply, e = conn.Receive()
+			if _, _, _, ok := redirect(e); ok && moved == nil {
+				moved = e
+			}
+			if e != nil && err == nil {
+				err = e
+			}
+		}
+		conn.Close()
+		if kind, slot, target, ok := redirect(moved); ok {
+			if kind == "MOVED" {
+				c.moved(slot, target)
+			}
+			addr = target
+			continue
+		}
+		return reply, err
+	}
+	return nil, err
+}
+
+// keySlot 计算 key 所在的 slot, 有 hash tag 时只使用 {} 中的部分
+func keySlot(key string) int {
+	return int(crc16(hashTag(key)) % clusterSlots)
+}
+
+// crc16 Redis Cluster 使用的 CRC16-CCITT (XMODEM)
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
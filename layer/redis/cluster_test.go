@@ -0,0 +1,186 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"ws-channels/common"
+	"ws-channels/config"
+)
+
+func TestKeySlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Errorf("crc16: got %x", crc)
+	}
+	cases := map[string]int{
+		"foo":                  12182,
+		"{user1000}.following": keySlot("{user1000}.followers"),
+		"{}foo":                int(crc16("{}foo") % clusterSlots),
+		"foo{bar}{zap}":        keySlot("bar"),
+	}
+	for key, slot := range cases {
+		if got := keySlot(key); got != slot {
+			t.Errorf("keySlot(%q): got %d, want %d", key, got, slot)
+		}
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	cases := []struct {
+		name string
+		args []interface{}
+		key  string
+	}{
+		{"SADD", []interface{}{"group:{a}", "node!user"}, "group:{a}"},
+		{"EVALSHA", []interface{}{"sha", 2, "history-seq:{a}", "history:{a}"}, "history-seq:{a}"},
+		{"XREADGROUP", []interface{}{"GROUP", "g", "c", "COUNT", 1, "STREAMS", "stream:{n}", ">"}, "stream:{n}"},
+		{"XGROUP", []interface{}{"CREATE", "stream:{n}", "g", "0"}, "stream:{n}"},
+		{"PUBLISH", []interface{}{"node:n", "data"}, ""},
+	}
+	for _, c := range cases {
+		if key, _ := commandKey(c.name, c.args); key != c.key {
+			t.Errorf("commandKey(%s): got %q, want %q", c.name, key, c.key)
+		}
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener
+}
+
+// fakeRedis 只实现测试需要的命令, handler 返回 RESP 格式的回复
+func fakeRedis(listener net.Listener, handler func(args []string) string) string {
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte(handler(args))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(value, "\r\n")
+	}
+	return args, nil
+}
+
+func TestClusterLayerSuite(t *testing.T) {
+	c := redisConfig(t)
+	c.ClusterAddrs = []string{c.Addr}
+	redisSuite(c, nil).Run(t)
+}
+
+// TestClusterRedirect 种子节点声称拥有所有 slot, 但对所有命令回复 MOVED 到真正的节点
+func TestClusterRedirect(t *testing.T) {
+	c := redisConfig(t)
+	listener := listen(t)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	var requests int32
+	seed := fakeRedis(listener, func(args []string) string {
+		if strings.EqualFold(args[0], "CLUSTER") {
+			// 空的 ip 表示与种子节点相同
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$0\r\n\r\n:%s\r\n", port)
+		}
+		atomic.AddInt32(&requests, 1)
+		return fmt.Sprintf("-MOVED %d %s\r\n", keySlot(args[1]), c.Addr)
+	})
+
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), &config.RedisConfig{ClusterAddrs: []string{seed}})
+	group := "cluster-redirect-" + common.RandomString(8)
+	channel := layer.NewChannel("")
+	if err := layer.GroupAdd(channel, group); err != nil {
+		t.Fatal(err)
+	}
+	if channels, err := layer.GetChannels(group); err != nil || len(channels) != 1 || channels[0] != channel {
+		t.Fatalf("channels: got %v %v", channels, err)
+	}
+	before := atomic.LoadInt32(&requests)
+	if before == 0 {
+		t.Fatal("seed node was never asked")
+	}
+	// MOVED 之后同一个 slot 的命令直接发给新节点
+	if _, err := layer.GetChannels(group); err != nil {
+		t.Fatal(err)
+	}
+	if after := atomic.LoadInt32(&requests); after != before {
+		t.Errorf("slot not updated after MOVED: %d requests to seed, want %d", after, before)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	c := redisConfig(t)
+	host, port, _ := net.SplitHostPort(c.Addr)
+	sentinel := fakeRedis(listen(t), func(args []string) string {
+		if len(args) == 3 && strings.EqualFold(args[0], "SENTINEL") && args[2] == "mymaster" {
+			return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		}
+		return "*-1\r\n"
+	})
+	// 第一个 sentinel 无法连接时使用下一个
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), &config.RedisConfig{
+		SentinelAddrs:  []string{deadAddr, sentinel},
+		SentinelMaster: "mymaster",
+	})
+	group := "sentinel-" + common.RandomString(8)
+	channel := layer.NewChannel("")
+	if err := layer.GroupAdd(channel, group); err != nil {
+		t.Fatal(err)
+	}
+	if channels, err := layer.GetChannels(group); err != nil || len(channels) != 1 || channels[0] != channel {
+		t.Fatalf("channels: got %v %v", channels, err)
+	}
+
+	unknown := NewLayer(make(chan common.ReceiverLayerMessage, 10), &config.RedisConfig{
+		SentinelAddrs:  []string{sentinel},
+		SentinelMaster: "unknown",
+	})
+	if _, err := unknown.GetChannels(group); err == nil {
+		t.Error("expected error for unknown master")
+	}
+}
@@ -0,0 +1,121 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+	"ws-channels/common"
+)
+
+// historyScript 原子地分配序号并写入历史, 保证 list 中的顺序与序号一致;
+// 每条记录的格式为 序号:毫秒时间戳:编码后的消息, 最新的在表头
+var historyScript = redis.NewScript(2, `
+local seq = redis.call('INCR', KEYS[1])
+redis.call('LPUSH', KEYS[2], seq .. ':' .. ARGV[1] .. ':' .. ARGV[2])
+local size = tonumber(ARGV[3])
+if size > 0 then
+	redis.call('LTRIM', KEYS[2], 0, size - 1)
+end
+local cutoff = tonumber(ARGV[4])
+if cutoff > 0 then
+	while true do
+		local last = redis.call('LINDEX', KEYS[2], -1)
+		if not last then
+			break
+		end
+		local t = tonumber(string.match(last, '^%d+:(%d+):'))
+		if t == nil or t >= cutoff then
+			break
+		end
+		redis.call('RPOP', KEYS[2])
+	end
+end
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+redis.call('EXPIRE', KEYS[2], ARGV[5])
+return seq
+`)
+
+func (layer Layer) historyKey(group string) string {
+	return "history:" + layer.tag(group)
+}
+
+func (layer Layer) historySeqKey(group string) string {
+	return "history-seq:" + layer.tag(group)
+}
+
+func (layer Layer) historyEnabled() bool {
+	return layer.HistorySize > 0 || layer.HistoryTTL > 0
+}
+
+// historyExpiry 历史和序号的过期时间, 至少要和 group 一样长, 否则序号重置后客户端会漏掉消息
+func (layer Layer) historyExpiry() int {
+	expiry := layer.GroupExpiry
+	if ttl := int(layer.HistoryTTL / time.Second); ttl > expiry {
+		expiry = ttl
+	}
+	return expiry
+}
+
+// pushHistory 写入历史并返回消息的序号
+func (layer Layer) pushHistory(client redis.Conn, group string, message common.Message) (uint64, error) {
+	data, err := layer.Codec.Marshal(common.ReceiverLayerMessage{Message: message})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var cutoff int64
+	if layer.HistoryTTL > 0 {
+		cutoff = toMillis(now.Add(-layer.HistoryTTL))
+	}
+	seq, err := redis.Uint64(historyScript.Do(client, layer.historySeqKey(group), layer.historyKey(group),
+		toMillis(now), data, layer.HistorySize, cutoff, layer.historyExpiry()))
+	return seq, err
+}
+
+func (layer Layer) GroupHistory(group string, since uint64) ([]common.HistoryMessage, error) {
+	if !layer.historyEnabled() {
+		return nil, nil
+	}
+	client := layer.getPool().Get()
+	defer client.Close()
+	entries, err := redis.ByteSlices(client.Do("LRANGE", layer.historyKey(group), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	var cutoff time.Time
+	if layer.HistoryTTL > 0 {
+		cutoff = time.Now().Add(-layer.HistoryTTL)
+	}
+	result := make([]common.HistoryMessage, 0)
+	// list 中最新的在前面, 倒序遍历得到升序结果
+	for i := len(entries) - 1; i >= 0; i-- {
+		parts := bytes.SplitN(entries[i], []byte(":"), 3)
+		if len(parts) != 3 {
+			continue
+		}
+		seq, err := strconv.ParseUint(string(parts[0]), 10, 64)
+		if err != nil || seq <= since {
+			continue
+		}
+		millis, err := strconv.ParseInt(string(parts[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Unix(0, millis*int64(time.Millisecond))
+		if at.Before(cutoff) {
+			continue
+		}
+		var msg common.ReceiverLayerMessage
+		if err := layer.Codec.Unmarshal(parts[2], &msg); err != nil {
+			layer.Logger.Warn("invalid history message", "group", group, "seq", seq, "error", err)
+			continue
+		}
+		result = append(result, common.HistoryMessage{Seq: seq, Time: at, Message: msg.Message})
+	}
+	return result, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
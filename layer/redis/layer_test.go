@@ -1,12 +1,23 @@
 package redis
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 	"ws-channels/common"
 	"ws-channels/config"
+	"ws-channels/layer/layertest"
+	"ws-channels/logger"
+	"ws-channels/metrics"
 )
 
 type msg struct {
@@ -14,20 +25,326 @@ type msg struct {
 	Content string `json:"content"`
 }
 
-func newLayer() *Layer {
-	c := &config.RedisConfig{
-		Addr:     "127.0.0.1:6379",
+// redisConfig 通过 REDIS_ADDR 指定测试使用的 redis, 连接不上时跳过测试
+func redisConfig(t *testing.T) *config.RedisConfig {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+	conn, err := redis.DialTimeout("tcp", addr, time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Skip("redis unavailable:", err)
+	}
+	_ = conn.Close()
+	return &config.RedisConfig{
+		Addr:     addr,
 		Password: "",
 		DB:       0,
 	}
+}
+
+func newLayer(t *testing.T) *Layer {
 	receiverMessage := make(chan common.ReceiverLayerMessage, 50)
-	layer := NewLayer(receiverMessage, c)
+	layer := NewLayer(receiverMessage, redisConfig(t))
 	layer.Run(context.Background())
 	return layer
 }
 
+// redisSuite 使用 c 创建 layer 的测试套件, setup 不为 nil 时在创建后修改 layer
+func redisSuite(c *config.RedisConfig, setup func(layer *Layer)) layertest.Suite {
+	return layertest.Suite{
+		New: func(receiverMessage chan common.ReceiverLayerMessage) common.LayerInterface {
+			layer := NewLayer(receiverMessage, c)
+			if setup != nil {
+				setup(layer)
+			}
+			return layer
+		},
+		SetExpiry: func(layer common.LayerInterface, expiry time.Duration) {
+			layer.(*Layer).GroupExpiry = int(expiry / time.Second)
+		},
+		SetHistory: func(layer common.LayerInterface, size int, ttl time.Duration) {
+			layer.(*Layer).HistorySize, layer.(*Layer).HistoryTTL = size, ttl
+		},
+		SetNodeLease: func(layer common.LayerInterface, lease time.Duration) {
+			layer.(*Layer).NodeLease = lease
+		},
+		// receiverTask 的 BRPOP 最长阻塞 5 秒
+		ShutdownTimeout: 6 * time.Second,
+	}
+}
+
+func TestLayerSuite(t *testing.T) {
+	redisSuite(redisConfig(t), nil).Run(t)
+}
+
+func TestPubSubLayerSuite(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisPubSubTransport
+	redisSuite(c, nil).Run(t)
+}
+
+func TestStreamLayerSuite(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisStreamTransport
+	c.StreamMaxLen = 1000
+	redisSuite(c, nil).Run(t)
+}
+
+func TestCodecLayerSuite(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisPubSubTransport
+	for _, codec := range []common.Codec{common.MsgPackCodec, common.ProtobufCodec} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			redisSuite(c, func(layer *Layer) {
+				layer.Codec = codec
+			}).Run(t)
+		})
+	}
+}
+
+// TestPubSubGroupAddConfirmed GroupAdd 返回时已经完成订阅, 紧接着发布的 group 消息不会丢失
+func TestPubSubGroupAddConfirmed(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisPubSubTransport
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), c)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_ = layer.Run(ctx)
+	publisher := layer.transport.(groupPublisher)
+	client := layer.getPool().Get()
+	defer client.Close()
+
+	channel := layer.NewChannel("")
+	for i := 0; i < 20; i++ {
+		group := "pubsub-confirm:" + common.RandomString(8)
+		if err := layer.GroupAdd(channel, group); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := layer.Codec.Marshal(common.ReceiverLayerMessage{Message: common.Message{MessageType: websocket.TextMessage, Data: []byte(group)}, Groups: []string{group}})
+		if err := publisher.publishGroup(client, group, data); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-layer.ReceiverMessage:
+			if string(msg.Message.Data) != group {
+				t.Fatalf("got %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message published right after GroupAdd lost")
+		}
+	}
+}
+
+// TestPubSubInvalidMessage 无法解码的消息记录日志后丢弃
+func TestPubSubInvalidMessage(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisPubSubTransport
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), c)
+	var out bytes.Buffer
+	layer.Logger = logger.New(&out, logger.LevelWarn)
+	ctx, cancel := context.WithCancel(context.Background())
+	_ = layer.Run(ctx)
+
+	client := layer.getPool().Get()
+	defer client.Close()
+	if err := layer.transport.push(client, layer.clientPrefix, []byte("not a message")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	layer.Wait()
+	if !strings.Contains(out.String(), "invalid pubsub message") {
+		t.Errorf("decode failure not logged: %s", out.String())
+	}
+}
+
+// TestPubSubGroupSendMetrics 直接发布到 group 的消息也记录 redis 耗时
+func TestPubSubGroupSendMetrics(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisPubSubTransport
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), c)
+	registry := metrics.NewRegistry()
+	layer.Metrics = registry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_ = layer.Run(ctx)
+
+	group := "pubsub-metrics:" + common.RandomString(8)
+	if err := layer.GroupAdd(layer.NewChannel(""), group); err != nil {
+		t.Fatal(err)
+	}
+	if err := layer.GroupSend(common.Message{MessageType: websocket.TextMessage, Data: []byte("hi")}, group); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-layer.ReceiverMessage:
+	case <-time.After(5 * time.Second):
+		t.Fatal("group message not received")
+	}
+	// 订阅方可能先于发布方收到回复
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		if body = recorder.Body.String(); strings.Contains(body, metrics.RedisSendSeconds+"_count 1\n") {
+			return
+		}
+	}
+	t.Errorf("group publish not observed:\n%s", body)
+}
+
+// TestInvalidNodeLease 过短的租约回退到默认值, 不会让 nodeTask 的 ticker panic
+func TestInvalidNodeLease(t *testing.T) {
+	for _, lease := range []time.Duration{0, -time.Second, 2} {
+		layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), redisConfig(t))
+		layer.NodeLease = lease
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := layer.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if layer.NodeLease != DefaultNodeLease {
+			t.Errorf("lease %v: got %v, want %v", lease, layer.NodeLease, DefaultNodeLease)
+		}
+		cancel()
+		layer.Wait()
+	}
+}
+
+// TestRunRedisUnavailable 启动时连不上 redis 也启动后台任务, redis 恢复后节点完成注册
+func TestRunRedisUnavailable(t *testing.T) {
+	c := redisConfig(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), &config.RedisConfig{Addr: addr})
+	layer.NodeLease = 300 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := layer.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 在原来的地址上把连接转发给测试使用的 redis
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("address reused:", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", c.Addr)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go func() {
+				_, _ = io.Copy(upstream, conn)
+				_ = upstream.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(conn, upstream)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		nodes, _ := layer.Nodes()
+		for _, node := range nodes {
+			if node == layer.clientPrefix {
+				return
+			}
+		}
+	}
+	t.Fatal("node not registered after redis became available")
+}
+
+// TestStreamReceiveRetry redis 不可用时接收任务等待后再重试, 不会空转
+func TestStreamReceiveRetry(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), &config.RedisConfig{Addr: addr, Transport: config.RedisStreamTransport})
+	var out bytes.Buffer
+	layer.Logger = logger.New(&out, logger.LevelWarn)
+	ctx, cancel := context.WithCancel(context.Background())
+	_ = layer.Run(ctx)
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	layer.Wait()
+
+	if n := strings.Count(out.String(), "stream receive failed"); n > layer.ReceiverTaskNum {
+		t.Errorf("%d receive attempts in 300ms with %d tasks", n, layer.ReceiverTaskNum)
+	}
+}
+
+// TestStreamRedelivery 未确认的消息在节点用相同名称重启后重新投递
+func TestStreamRedelivery(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisStreamTransport
+	sender := NewLayer(make(chan common.ReceiverLayerMessage, 10), c)
+	named := *c
+	named.NodeName = "stream-test-" + common.RandomString(8)
+
+	start := func() (*Layer, context.CancelFunc) {
+		layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), &named)
+		ctx, cancel := context.WithCancel(context.Background())
+		_ = layer.Run(ctx)
+		return layer, cancel
+	}
+	receive := func(layer *Layer) *common.ReceiverLayerMessage {
+		select {
+		case msg := <-layer.ReceiverMessage:
+			return &msg
+		case <-time.After(6 * time.Second):
+			return nil
+		}
+	}
+
+	first, cancel := start()
+	channel := first.NewChannel("")
+	if err := sender.Send(common.Message{MessageType: websocket.TextMessage, Data: []byte("redeliver")}, channel); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(first); msg == nil || msg.Ack == nil {
+		t.Fatal("message not received")
+	}
+	// 不确认消息直接停止节点, 模拟投递前崩溃
+	cancel()
+	time.Sleep(6 * time.Second)
+
+	second, cancel := start()
+	msg := receive(second)
+	if msg == nil || string(msg.Message.Data) != "redeliver" {
+		t.Fatal("pending message not redelivered")
+	}
+	msg.Ack()
+	cancel()
+	time.Sleep(6 * time.Second)
+
+	third, cancel := start()
+	defer cancel()
+	if msg := receive(third); msg != nil {
+		t.Error("acknowledged message redelivered", msg)
+	}
+}
+
 func TestLayer(t *testing.T) {
-	layer := newLayer()
+	layer := newLayer(t)
 	groups := []string{"groupA", "groupB", "groupC"}
 	channels := []string{layer.NewChannel(""), layer.NewChannel(""), layer.NewChannel("")}
 	for i := 0; i < 2; i++ {
@@ -102,8 +419,8 @@ func GroupSend(layer *Layer, groups []string, t *testing.T) {
 			t.Error(err)
 		}
 		d := <-layer.ReceiverMessage
-		if len(d.Channels) != 2 || string(d.Message.Data) != string(content) {
-			t.Error("error", d.Channels)
+		if len(d.Groups) != 1 || string(d.Message.Data) != string(content) {
+			t.Error("error", d.Groups)
 		}
 	}
 	{
@@ -117,8 +434,8 @@ func GroupSend(layer *Layer, groups []string, t *testing.T) {
 		}
 		d := <-layer.ReceiverMessage
 
-		if len(d.Channels) != 3 || string(d.Message.Data) != string(content) {
-			t.Error("error", d.Channels)
+		if len(d.Groups) != 3 || string(d.Message.Data) != string(content) {
+			t.Error("error", d.Groups)
 		}
 	}
 
@@ -133,7 +450,7 @@ func GroupSend(layer *Layer, groups []string, t *testing.T) {
 		}
 		d := <-layer.ReceiverMessage
 
-		if len(d.Channels) != 1 {
+		if len(d.Groups) != 1 || d.Groups[0] != groups[1] {
 			t.Error("error")
 		}
 	}
@@ -142,7 +459,7 @@ func GroupSend(layer *Layer, groups []string, t *testing.T) {
 
 func Send(layer *Layer, channels []string, t *testing.T) {
 	data := "测试单发消息"
-	d := common.Message{websocket.TextMessage, []byte(data)}
+	d := common.Message{MessageType: websocket.TextMessage, Data: []byte(data)}
 	if err := layer.Send(d, channels[0]); err != nil {
 		t.Error("error")
 	}
@@ -154,3 +471,45 @@ func Send(layer *Layer, channels []string, t *testing.T) {
 	}
 
 }
+
+// TestStreamRedeliveryAfterReap 节点租约过期被清理后用相同名称重启, 未确认的消息仍然重新投递
+func TestStreamRedeliveryAfterReap(t *testing.T) {
+	c := redisConfig(t)
+	c.Transport = config.RedisStreamTransport
+	sender := NewLayer(make(chan common.ReceiverLayerMessage, 10), c)
+	named := *c
+	named.NodeName = "stream-reap-" + common.RandomString(8)
+	named.NodeLease = 200 * time.Millisecond
+
+	first := NewLayer(make(chan common.ReceiverLayerMessage, 10), &named)
+	ctx, cancel := context.WithCancel(context.Background())
+	_ = first.Run(ctx)
+	if err := sender.Send(common.Message{MessageType: websocket.TextMessage, Data: []byte("reaped")}, first.NewChannel("")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.ReceiverMessage:
+	case <-time.After(6 * time.Second):
+		t.Fatal("message not received")
+	}
+	cancel()
+	first.Wait()
+	time.Sleep(2 * named.NodeLease)
+	if err := sender.reap(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewLayer(make(chan common.ReceiverLayerMessage, 10), &named)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_ = second.Run(ctx)
+	select {
+	case msg := <-second.ReceiverMessage:
+		if string(msg.Message.Data) != "reaped" {
+			t.Fatalf("got %+v", msg)
+		}
+		msg.Ack()
+	case <-time.After(6 * time.Second):
+		t.Fatal("pending message not redelivered after reap")
+	}
+}
@@ -0,0 +1,155 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	nodesKey          = "nodes"
+	DefaultNodeLease  = 30 * time.Second
+	reaperLockTimeout = time.Minute
+	// minNodeLease 租约以毫秒记录, 每 NodeLease/3 续约一次, 更短的租约没有意义
+	minNodeLease = 100 * time.Millisecond
+)
+
+// removeNodeScript 清理期间节点可能已经重新注册, 只移除租约仍然过期的记录
+var removeNodeScript = redis.NewScript(1, `
+local lease = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if lease and tonumber(lease) < tonumber(ARGV[2]) then
+	return redis.call('ZREM', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// nodeGroupsKey 记录节点的 channel 加入过的 group, 节点失效后据此清理
+func (layer Layer) nodeGroupsKey(node string) string {
+	return "node-groups:" + layer.tag(node)
+}
+
+// nodeUsersKey 记录节点的 channel 属于哪些用户
+func (layer Layer) nodeUsersKey(node string) string {
+	return "node-users:" + layer.tag(node)
+}
+
+func (Layer) reaperLockKey(node string) string {
+	return "reaper:" + node
+}
+
+// Nodes 返回租约未过期的节点
+func (layer Layer) Nodes() ([]string, error) {
+	client := layer.getPool().Get()
+	defer client.Close()
+	return redis.Strings(client.Do("ZRANGEBYSCORE", nodesKey, toMillis(time.Now()), "+inf"))
+}
+
+// heartbeat 续约本节点, 租约到期时间作为 zset 的 score
+func (layer Layer) heartbeat(client redis.Conn) error {
+	_, err := client.Do("ZADD", nodesKey, toMillis(time.Now().Add(layer.NodeLease)), layer.clientPrefix)
+	return err
+}
+
+// nodeTask 定时续约并清理租约过期的节点; 正常退出时不注销, 使用相同 NodeName 重启的节点可以继续使用原来的数据
+func (layer *Layer) nodeTask(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			layer.Logger.Error("node task panic, restarting", "node", layer.clientPrefix, "panic", r, "stack", string(debug.Stack()))
+			layer.restartTask(ctx, "node", func() { layer.nodeTask(ctx) })
+		}
+	}()
+
+	heartbeat := time.NewTicker(layer.NodeLease / 3)
+	defer heartbeat.Stop()
+	reap := time.NewTicker(layer.NodeLease)
+	defer reap.Stop()
+	for {
+		select {
+		case <-heartbeat.C:
+			client := layer.getPool().Get()
+			if err := layer.heartbeat(client); err != nil {
+				layer.Logger.Warn("node heartbeat failed", "node", layer.clientPrefix, "error", err)
+			}
+			client.Close()
+		case <-reap.C:
+			if err := layer.reap(); err != nil {
+				layer.Logger.Warn("node reap failed", "node", layer.clientPrefix, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reap 清理所有租约过期的节点, 多个节点同时清理时通过锁保证每个节点只清理一次
+func (layer Layer) reap() error {
+	client := layer.getPool().Get()
+	defer client.Close()
+	dead, err := redis.Strings(client.Do("ZRANGEBYSCORE", nodesKey, "-inf", "("+fmt.Sprint(toMillis(time.Now()))))
+	if err != nil {
+		return err
+	}
+	for _, node := range dead {
+		if node == layer.clientPrefix {
+			continue
+		}
+		locked, err := client.Do("SET", layer.reaperLockKey(node), layer.clientPrefix, "NX", "PX", int64(reaperLockTimeout/time.Millisecond))
+		if err != nil {
+			return err
+		}
+		if locked == nil {
+			continue
+		}
+		if err := layer.reapNode(client, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reapNode 从 group、用户和 presence 中移除节点的 channel, 并删除它的 list 收件箱;
+// stream 保留到 GroupExpiry 过期, 节点用相同的 NodeName 重启后仍然可以重新投递未确认的消息
+func (layer Layer) reapNode(client redis.Conn, node string) error {
+	prefix := node + "!"
+	purge := func(indexKey string, key func(string) string) error {
+		names, err := redis.Strings(client.Do("SMEMBERS", indexKey))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			channels, err := redis.Strings(client.Do("SMEMBERS", key(name)))
+			if err != nil {
+				return err
+			}
+			args := []interface{}{key(name)}
+			for _, channel := range channels {
+				if strings.HasPrefix(channel, prefix) {
+					args = append(args, channel)
+				}
+			}
+			if len(args) > 1 {
+				if _, err := client.Do("SREM", args...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := purge(layer.nodeGroupsKey(node), layer.groupKey); err != nil {
+		return err
+	}
+	if err := purge(layer.nodeUsersKey(node), layer.userKey); err != nil {
+		return err
+	}
+	if err := layer.reapPresence(client, node); err != nil {
+		return err
+	}
+	if _, err := client.Do("DEL", layer.inboxKey(node), layer.nodeGroupsKey(node), layer.nodeUsersKey(node), layer.nodePresenceKey(node)); err != nil {
+		return err
+	}
+	_, err := removeNodeScript.Do(client, nodesKey, node, toMillis(time.Now()))
+	return err
+}
@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+	"ws-channels/common"
+)
+
+// offlinePushScript 追加一条离线消息, 从表头弹出并返回超过长度或早于 cutoff 的消息;
+// 每条记录的格式为 毫秒时间戳:编码后的消息
+var offlinePushScript = redis.NewScript(1, `
+redis.call('RPUSH', KEYS[1], ARGV[1])
+local dropped = {}
+local maxLen = tonumber(ARGV[2])
+if maxLen > 0 then
+	while redis.call('LLEN', KEYS[1]) > maxLen do
+		table.insert(dropped, redis.call('LPOP', KEYS[1]))
+	end
+end
+local cutoff = tonumber(ARGV[4])
+while true do
+	local first = redis.call('LINDEX', KEYS[1], 0)
+	if not first then
+		break
+	end
+	local t = tonumber(string.match(first, '^(%d+):'))
+	if t == nil or t >= cutoff then
+		break
+	end
+	table.insert(dropped, redis.call('LPOP', KEYS[1]))
+end
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return dropped
+`)
+
+func (Layer) offlineKey(channel string) string {
+	return "offline:" + channel
+}
+
+// offlineExpiry 队列保留 ttl 的两倍; 过期的消息由 Server 在写入时或定期清理时报告,
+// 这里的过期只用来清理节点崩溃后留下的队列
+func offlineExpiry(ttl time.Duration) int {
+	expiry := int(2 * ttl / time.Second)
+	if expiry < 1 {
+		expiry = 1
+	}
+	return expiry
+}
+
+func (layer Layer) OfflinePush(channel string, message common.Message, maxLen int, ttl time.Duration) ([]common.Message, error) {
+	data, err := layer.Codec.Marshal(common.ReceiverLayerMessage{Message: message})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entry := append([]byte(strconv.FormatInt(toMillis(now), 10)+":"), data...)
+	var cutoff int64
+	if ttl > 0 {
+		cutoff = toMillis(now.Add(-ttl))
+	}
+
+	client := layer.getPool().Get()
+	defer client.Close()
+	entries, err := redis.ByteSlices(offlinePushScript.Do(client, layer.offlineKey(channel), entry, maxLen, offlineExpiry(ttl), cutoff))
+	if err != nil {
+		return nil, err
+	}
+	dropped, _ := layer.parseOffline(channel, entries, 0)
+	return dropped, nil
+}
+
+func (layer Layer) OfflineDrain(channel string, ttl time.Duration) ([]common.Message, []common.Message, error) {
+	client := layer.getPool().Get()
+	defer client.Close()
+	key := layer.offlineKey(channel)
+	_ = client.Send("MULTI")
+	_ = client.Send("LRANGE", key, 0, -1)
+	_ = client.Send("DEL", key)
+	replies, err := redis.Values(client.Do("EXEC"))
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := redis.ByteSlices(replies[0], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, expired := layer.parseOffline(channel, entries, ttl)
+	return messages, expired, nil
+}
+
+// parseOffline 解析队列中的记录, ttl 大于 0 时超过 ttl 的消息放在 expired 中
+func (layer Layer) parseOffline(channel string, entries [][]byte, ttl time.Duration) (messages []common.Message, expired []common.Message) {
+	now := time.Now()
+	for _, entry := range entries {
+		parts := bytes.SplitN(entry, []byte(":"), 2)
+		if len(parts) != 2 {
+			continue
+		}
+		millis, err := strconv.ParseInt(string(parts[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		var msg common.ReceiverLayerMessage
+		if err := layer.Codec.Unmarshal(parts[1], &msg); err != nil {
+			layer.Logger.Warn("invalid offline message", "channel", channel, "error", err)
+			continue
+		}
+		if ttl > 0 && now.Sub(time.Unix(0, millis*int64(time.Millisecond))) > ttl {
+			expired = append(expired, msg.Message)
+		} else {
+			messages = append(messages, msg.Message)
+		}
+	}
+	return messages, expired
+}
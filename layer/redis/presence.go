@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strings"
+	"ws-channels/common"
+)
+
+// presenceKey 每个 group 一个 hash, field 为 channel, 值为 JSON 编码的 PresenceInfo
+func (layer Layer) presenceKey(group string) string {
+	return "presence:" + layer.tag(group)
+}
+
+// nodePresenceKey 记录节点的 channel 在哪些 group 中在线
+func (layer Layer) nodePresenceKey(node string) string {
+	return "node-presence:" + layer.tag(node)
+}
+
+func (layer Layer) PresenceAdd(group string, info common.PresenceInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	client := layer.getPool().Get()
+	defer client.Close()
+	key := layer.presenceKey(group)
+	if _, err := client.Do("HSET", key, info.Channel, data); err != nil {
+		return err
+	}
+	if _, err := client.Do("EXPIRE", key, layer.GroupExpiry); err != nil {
+		return err
+	}
+	return layer.index(client, layer.nodePresenceKey(layer.noneLocalName(info.Channel)), group)
+}
+
+func (layer Layer) PresenceDiscard(group string, channel string) error {
+	client := layer.getPool().Get()
+	defer client.Close()
+	_, err := client.Do("HDEL", layer.presenceKey(group), channel)
+	return err
+}
+
+func (layer Layer) Presence(group string) ([]common.PresenceInfo, error) {
+	client := layer.getPool().Get()
+	defer client.Close()
+	values, err := redis.ByteSlices(client.Do("HVALS", layer.presenceKey(group)))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]common.PresenceInfo, 0, len(values))
+	for _, value := range values {
+		var info common.PresenceInfo
+		if err := json.Unmarshal(value, &info); err != nil {
+			layer.Logger.Warn("invalid presence entry", "group", group, "error", err)
+			continue
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Channel < result[j].Channel
+	})
+	return result, nil
+}
+
+// reapPresence 移除失效节点的在线记录, 并向 group 广播 leave 事件
+func (layer Layer) reapPresence(client redis.Conn, node string) error {
+	prefix := node + "!"
+	groups, err := redis.Strings(client.Do("SMEMBERS", layer.nodePresenceKey(node)))
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		entries, err := redis.StringMap(client.Do("HGETALL", layer.presenceKey(group)))
+		if err != nil {
+			return err
+		}
+		for channel, data := range entries {
+			if !strings.HasPrefix(channel, prefix) {
+				continue
+			}
+			if _, err := client.Do("HDEL", layer.presenceKey(group), channel); err != nil {
+				return err
+			}
+			var info common.PresenceInfo
+			if err := json.Unmarshal([]byte(data), &info); err != nil {
+				layer.Logger.Warn("invalid presence entry", "group", group, "channel", channel, "error", err)
+				continue
+			}
+			message, err := common.PresenceMessage(common.PresenceEvent{Type: common.PresenceLeave, Group: group, PresenceInfo: info})
+			if err != nil {
+				return err
+			}
+			if err := layer.GroupSend(message, group); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
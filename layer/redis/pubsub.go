@@ -0,0 +1,357 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"sync"
+	"time"
+	"ws-channels/common"
+)
+
+const (
+	pubSubPingInterval  = 10 * time.Second
+	pubSubReadTimeout   = 3 * pubSubPingInterval
+	pubSubRetryInterval = time.Second
+	// pubSubReplyExpiry 订阅请求的回复在 redis 中保留的秒数, 请求方超时后由过期清理
+	pubSubReplyExpiry = 60
+)
+
+var (
+	errSubscribeTimeout = errors.New("redis: group subscription not confirmed")
+	errPubSubClosed     = errors.New("redis: pubsub connection closed")
+)
+
+// groupRequest 其他节点把本节点的 channel 加入或移出 group 时, 通过控制频道请求本节点订阅或退订,
+// 收到确认后 LPUSH 到 Reply
+type groupRequest struct {
+	Channel string   `json:"channel"`
+	Groups  []string `json:"groups"`
+	Discard bool     `json:"discard,omitempty"`
+	Reply   string   `json:"reply,omitempty"`
+}
+
+// pubSubTransport 节点订阅自己的频道以及本节点有成员的 group 频道, 连接断开后自动重新订阅
+type pubSubTransport struct {
+	layer *Layer
+
+	mu     sync.Mutex
+	conn   *redis.PubSubConn
+	groups map[string]map[string]bool
+	// waiting 等待订阅或退订确认的 group 频道, key 为 waitKey, 确认后或连接断开时通知
+	waiting map[string][]chan error
+}
+
+func newPubSubTransport(layer *Layer) *pubSubTransport {
+	return &pubSubTransport{
+		layer:   layer,
+		groups:  make(map[string]map[string]bool),
+		waiting: make(map[string][]chan error),
+	}
+}
+
+func (t *pubSubTransport) nodeChannel(serverKey string) string {
+	return "node:" + serverKey
+}
+
+// controlChannel 接收其他节点发来的 groupRequest
+func (t *pubSubTransport) controlChannel(serverKey string) string {
+	return "node-control:" + serverKey
+}
+
+func (t *pubSubTransport) push(client redis.Conn, serverKey string, data []byte) error {
+	_, err := client.Do("PUBLISH", t.nodeChannel(serverKey), data)
+	return err
+}
+
+func (t *pubSubTransport) publishGroup(client redis.Conn, group string, data []byte) error {
+	_, err := client.Do("PUBLISH", t.layer.groupKey(group), data)
+	return err
+}
+
+// groupAdd 本节点的 channel 直接订阅; 其他节点的 channel 请求所在节点订阅. 都等待订阅确认后返回,
+// 这样紧接着发布的 group 消息不会丢失
+func (t *pubSubTransport) groupAdd(channel string, groups ...string) error {
+	if !t.layer.isLocal(channel) {
+		return t.request(groupRequest{Channel: channel, Groups: groups})
+	}
+	return t.wait(t.add(channel, groups...))
+}
+
+func waitKey(kind string, channel string) string {
+	return kind + " " + channel
+}
+
+// waiter 在持有 mu 时调用, 连接断开时不需要等待
+func (t *pubSubTransport) waiter(kind string, key string) []chan error {
+	if t.conn == nil {
+		return nil
+	}
+	waiter := make(chan error, 1)
+	t.waiting[waitKey(kind, key)] = append(t.waiting[waitKey(kind, key)], waiter)
+	return []chan error{waiter}
+}
+
+// add 记录成员, 返回新订阅的 group 频道的确认通知
+func (t *pubSubTransport) add(channel string, groups ...string) []chan error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subscribe := make([]interface{}, 0)
+	waiters := make([]chan error, 0)
+	for _, group := range groups {
+		key := t.layer.groupKey(group)
+		if value, ok := t.groups[group]; ok {
+			value[channel] = true
+			// 其他成员加入时发出的订阅还没有确认
+			if _, pending := t.waiting[waitKey("subscribe", key)]; !pending {
+				continue
+			}
+		} else {
+			t.groups[group] = map[string]bool{channel: true}
+			subscribe = append(subscribe, key)
+		}
+		waiters = append(waiters, t.waiter("subscribe", key)...)
+	}
+	if t.conn != nil && len(subscribe) > 0 {
+		// 订阅失败时连接会断开, 等待中的 waiter 收到错误, 重连后会按 groups 重新订阅
+		_ = t.conn.Subscribe(subscribe...)
+	}
+	return waiters
+}
+
+// wait 等待订阅或退订确认
+func (t *pubSubTransport) wait(waiters []chan error) error {
+	timer := time.NewTimer(pubSubReadTimeout)
+	defer timer.Stop()
+	for _, waiter := range waiters {
+		select {
+		case err := <-waiter:
+			if err != nil {
+				return err
+			}
+		case <-timer.C:
+			return errSubscribeTimeout
+		}
+	}
+	return nil
+}
+
+// confirm 收到确认或连接断开时通知等待的 waiter, key 为空时通知所有 waiter
+func (t *pubSubTransport) confirm(key string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, waiters := range t.waiting {
+		if key != "" && k != key {
+			continue
+		}
+		for _, waiter := range waiters {
+			waiter <- err
+		}
+		delete(t.waiting, k)
+	}
+}
+
+func (t *pubSubTransport) groupDiscard(channel string, groups ...string) error {
+	if !t.layer.isLocal(channel) {
+		return t.request(groupRequest{Channel: channel, Groups: groups, Discard: true})
+	}
+	return t.wait(t.discard(channel, groups...))
+}
+
+// discard 移除成员, 返回退订的 group 频道的确认通知
+func (t *pubSubTransport) discard(channel string, groups ...string) []chan error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unsubscribe := make([]interface{}, 0)
+	waiters := make([]chan error, 0)
+	for _, group := range groups {
+		if value, ok := t.groups[group]; ok {
+			delete(value, channel)
+			if len(value) == 0 {
+				delete(t.groups, group)
+				unsubscribe = append(unsubscribe, t.layer.groupKey(group))
+				waiters = append(waiters, t.waiter("unsubscribe", t.layer.groupKey(group))...)
+			}
+		}
+	}
+	if t.conn != nil && len(unsubscribe) > 0 {
+		_ = t.conn.Unsubscribe(unsubscribe...)
+	}
+	return waiters
+}
+
+// request 把 groupRequest 发给 channel 所在的节点并等待对方订阅或退订完成;
+// 节点不在线时没有需要投递的连接, 直接返回
+func (t *pubSubTransport) request(request groupRequest) error {
+	request.Reply = "pubsub-reply:" + t.layer.tag(common.RandomString(16))
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client := t.layer.getPool().Get()
+	defer client.Close()
+	receivers, err := redis.Int(client.Do("PUBLISH", t.controlChannel(t.layer.noneLocalName(request.Channel)), data))
+	if err != nil || receivers == 0 {
+		return err
+	}
+	_, err = client.Do("BRPOP", request.Reply, int(pubSubReadTimeout/time.Second))
+	if err == redis.ErrNil {
+		return errSubscribeTimeout
+	}
+	return err
+}
+
+// handleRequest 在接收消息的 goroutine 中调用, 不能等待确认, 由单独的 goroutine 等待后回复
+func (t *pubSubTransport) handleRequest(data []byte) {
+	var request groupRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		t.layer.Logger.Warn("invalid pubsub group request", "error", err)
+		return
+	}
+	var waiters []chan error
+	if request.Discard {
+		waiters = t.discard(request.Channel, request.Groups...)
+	} else {
+		waiters = t.add(request.Channel, request.Groups...)
+	}
+	go func() {
+		if err := t.wait(waiters); err != nil {
+			t.layer.Logger.Warn("pubsub group request failed", "channel", request.Channel, "error", err)
+			return
+		}
+		client := t.layer.getPool().Get()
+		defer client.Close()
+		if _, err := client.Do("LPUSH", request.Reply, 1); err != nil {
+			t.layer.Logger.Warn("pubsub group reply failed", "channel", request.Channel, "error", err)
+			return
+		}
+		_, _ = client.Do("EXPIRE", request.Reply, pubSubReplyExpiry)
+	}()
+}
+
+// run 在返回前完成首次订阅, 之后在后台接收消息, 连接断开时重新订阅
+func (t *pubSubTransport) run(ctx context.Context) {
+	conn, pending, err := t.subscribe()
+	t.layer.goTask(func() {
+		for {
+			if err == nil {
+				err = t.receive(ctx, conn, pending)
+			}
+			if err != nil {
+				t.layer.Logger.Warn("pubsub receiver stopped, resubscribing", "node", t.layer.clientPrefix, "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pubSubRetryInterval):
+			}
+			conn, pending, err = t.subscribe()
+		}
+	})
+}
+
+// subscribe 建立一个独立的连接并订阅节点频道和本节点有成员的 group 频道,
+// 返回等待订阅确认期间收到的消息, 由 receive 先处理
+func (t *pubSubTransport) subscribe() (redis.PubSubConn, []redis.Message, error) {
+	// 不从连接池获取, 这样可以在其他 goroutine 中安全地关闭连接
+	c, err := t.layer.dial()
+	if err != nil {
+		return redis.PubSubConn{}, nil, err
+	}
+	conn := redis.PubSubConn{Conn: c}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	channels := []interface{}{t.nodeChannel(t.layer.clientPrefix), t.controlChannel(t.layer.clientPrefix)}
+	for group := range t.groups {
+		channels = append(channels, t.layer.groupKey(group))
+	}
+	if err := conn.Subscribe(channels...); err != nil {
+		_ = conn.Close()
+		return redis.PubSubConn{}, nil, err
+	}
+	// 等待订阅确认, 保证返回后发布的消息都能收到; 先订阅成功的频道可能已经收到消息
+	pending := make([]redis.Message, 0)
+	for confirmed := 0; confirmed < len(channels); {
+		switch v := conn.ReceiveWithTimeout(pubSubReadTimeout).(type) {
+		case redis.Subscription:
+			confirmed++
+		case redis.Message:
+			pending = append(pending, v)
+		case error:
+			_ = conn.Close()
+			return redis.PubSubConn{}, nil, v
+		}
+	}
+	t.conn = &conn
+	return conn, pending, nil
+}
+
+// receive 处理 pending 后接收消息, 直到连接出错或 ctx 结束
+func (t *pubSubTransport) receive(ctx context.Context, conn redis.PubSubConn, pending []redis.Message) error {
+	done := make(chan struct{})
+	defer func() {
+		t.mu.Lock()
+		t.conn = nil
+		t.mu.Unlock()
+		t.confirm("", errPubSubClosed)
+		close(done)
+		_ = conn.Close()
+	}()
+	go t.keepalive(ctx, conn, done)
+
+	for _, message := range pending {
+		t.message(message)
+	}
+	for {
+		switch v := conn.ReceiveWithTimeout(pubSubReadTimeout).(type) {
+		case redis.Subscription:
+			t.confirm(waitKey(v.Kind, v.Channel), nil)
+		case redis.Message:
+			t.message(v)
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
+
+// message 处理控制频道的请求, 其他频道的消息解码后交给服务端
+func (t *pubSubTransport) message(message redis.Message) {
+	if message.Channel == t.controlChannel(t.layer.clientPrefix) {
+		t.handleRequest(message.Data)
+		return
+	}
+	var msg common.ReceiverLayerMessage
+	if err := t.layer.Codec.Unmarshal(message.Data, &msg); err != nil {
+		t.layer.Logger.Warn("invalid pubsub message", "node", t.layer.clientPrefix, "channel", message.Channel, "codec", t.layer.Codec.Name(), "error", err)
+		return
+	}
+	t.layer.ReceiverMessage <- msg
+}
+
+// keepalive 定时 PING 以便及时发现断开的连接, ctx 结束时关闭连接让 subscribe 返回
+func (t *pubSubTransport) keepalive(ctx context.Context, conn redis.PubSubConn, done chan struct{}) {
+	ticker := time.NewTicker(pubSubPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			err := conn.Ping("")
+			t.mu.Unlock()
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			_ = conn.Close()
+			return
+		case <-done:
+			return
+		}
+	}
+}
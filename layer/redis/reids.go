@@ -2,17 +2,22 @@ package redis
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"ws-channels/common"
 	"ws-channels/config"
+	"ws-channels/logger"
+	"ws-channels/metrics"
 )
 
+// receiverRetryInterval 读取收件箱出错后等待多久再重试
+const receiverRetryInterval = time.Second
+
 type sendLayerGroupMessage struct {
 	Groups  []string       `json:"groups"`
 	Message common.Message `json:"message"`
@@ -23,14 +28,34 @@ type Layer struct {
 	ReceiverTaskNum int
 	SendTaskNum     int
 
-	client []*redis.Pool
+	// client 每个分片一个连接池, 不分片时只有一个
+	client []connPool
+	// pool 按 key 把命令路由到 client 中的连接池
+	pool connPool
+	// dial 建立不属于连接池的连接, pub/sub 使用
+	dial func() (redis.Conn, error)
+	// hashTags Redis Cluster 和分片模式下 key 使用 hash tag, 多个 key 的命令拆开执行
+	hashTags bool
 
 	ReceiverMessage chan common.ReceiverLayerMessage
 
 	clientPrefix     string
 	sendGroupMessage chan sendLayerGroupMessage
+	transport        transport
+	tasks            *sync.WaitGroup
 
 	MustSendRemote bool
+	// Codec 节点之间传递消息的编码, 默认为 JSON
+	Codec common.Codec
+	// NodeLease 节点租约的时长, 超过这个时间没有续约的节点会被其他节点清理; 小于 100ms 时 Run 使用 DefaultNodeLease
+	NodeLease time.Duration
+	// HistorySize 每个 group 保留的最近消息数, HistoryTTL 保留的时长, 都为 0 时不保留历史
+	HistorySize int
+	HistoryTTL  time.Duration
+	// Metrics 收集 redis 耗时和任务重启次数, 默认丢弃, 需要在 Run 之前设置
+	Metrics metrics.Collector
+	// Logger 输出后台任务中的错误, 默认为 logger.Default
+	Logger logger.Logger
 }
 
 func (layer Layer) GetChannels(group string) ([]string, error) {
@@ -52,6 +77,12 @@ func (layer Layer) GroupAdd(channel string, groups ...string) error {
 		}
 		_ = client.Send("EXPIRE", key, layer.GroupExpiry)
 	}
+	if err := layer.index(client, layer.nodeGroupsKey(layer.noneLocalName(channel)), groups...); err != nil {
+		return err
+	}
+	if watcher, ok := layer.transport.(groupWatcher); ok {
+		return watcher.groupAdd(channel, groups...)
+	}
 
 	return nil
 }
@@ -66,10 +97,52 @@ func (layer Layer) GroupDiscard(channel string, groups ...string) error {
 			return err
 		}
 	}
+	if watcher, ok := layer.transport.(groupWatcher); ok {
+		return watcher.groupDiscard(channel, groups...)
+	}
 
 	return nil
 }
 
+func (layer Layer) UserAdd(user string, channel string) error {
+	client := layer.getPool().Get()
+	defer client.Close()
+	key := layer.userKey(user)
+	if _, err := client.Do("SADD", key, channel); err != nil {
+		return err
+	}
+	if _, err := client.Do("EXPIRE", key, layer.GroupExpiry); err != nil {
+		return err
+	}
+	return layer.index(client, layer.nodeUsersKey(layer.noneLocalName(channel)), user)
+}
+
+// index 记录节点用到的 group 或用户, 节点失效后用来清理
+func (layer Layer) index(client redis.Conn, key string, names ...string) error {
+	args := []interface{}{key}
+	for _, name := range names {
+		args = append(args, name)
+	}
+	if _, err := client.Do("SADD", args...); err != nil {
+		return err
+	}
+	_, err := client.Do("EXPIRE", key, layer.GroupExpiry)
+	return err
+}
+
+func (layer Layer) UserDiscard(user string, channel string) error {
+	client := layer.getPool().Get()
+	defer client.Close()
+	_, err := client.Do("SREM", layer.userKey(user), channel)
+	return err
+}
+
+func (layer Layer) GetUserChannels(user string) ([]string, error) {
+	client := layer.getPool().Get()
+	defer client.Close()
+	return redis.Strings(client.Do("SMEMBERS", layer.userKey(user)))
+}
+
 func (layer Layer) GroupSend(message common.Message, groups ...string) error {
 	layer.sendGroupMessage <- sendLayerGroupMessage{
 		Groups:  groups,
@@ -82,15 +155,51 @@ func (layer *Layer) Run(ctx context.Context) error {
 	if len(layer.client) < 1 {
 		return errors.New("未配置redis")
 	}
-	for i := 0; i < layer.ReceiverTaskNum; i++ {
-		go layer.receiverTask(ctx)
+	if layer.NodeLease < minNodeLease {
+		layer.Logger.Warn("node lease too short, using default", "node", layer.clientPrefix, "lease", layer.NodeLease, "default", DefaultNodeLease)
+		layer.NodeLease = DefaultNodeLease
+	}
+	if layer.Metrics == nil {
+		layer.Metrics = metrics.Discard
 	}
-	for i := 0; i < layer.ReceiverTaskNum; i++ {
-		go layer.sendTask(ctx)
+	client := layer.getPool().Get()
+	// 启动时 redis 暂时不可用也启动所有任务, 由 nodeTask 重试心跳, 接收任务各自重连
+	if err := layer.heartbeat(client); err != nil {
+		layer.Logger.Warn("node heartbeat failed", "node", layer.clientPrefix, "error", err)
+	}
+	client.Close()
+	layer.goTask(func() { layer.nodeTask(ctx) })
+	layer.transport.run(ctx)
+	for i := 0; i < layer.SendTaskNum; i++ {
+		layer.goTask(func() { layer.sendTask(ctx) })
 	}
 	return nil
 }
 
+// Wait 等待 Run 启动的任务在 ctx 结束后全部退出
+func (layer Layer) Wait() {
+	layer.tasks.Wait()
+}
+
+// goTask 启动一个 Wait 需要等待的任务
+func (layer Layer) goTask(task func()) {
+	layer.tasks.Add(1)
+	go func() {
+		defer layer.tasks.Done()
+		task()
+	}()
+}
+
+// restartTask 任务 panic 后等待一段时间重新启动, ctx 已结束时不再启动
+func (layer Layer) restartTask(ctx context.Context, name string, task func()) {
+	layer.Metrics.Add(metrics.TaskRestartsTotal, 1, "task", name)
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		layer.goTask(task)
+	}
+}
+
 func (layer Layer) NewChannel(user string) string {
 	if user == "" {
 		user = common.RandomString(8)
@@ -99,26 +208,114 @@ func (layer Layer) NewChannel(user string) string {
 }
 
 func (layer *Layer) newClient(config *config.RedisConfig) {
-	layer.client = []*redis.Pool{
-		{
-			Dial: func() (conn redis.Conn, err error) {
-				return redis.Dial("tcp", config.Addr, redis.DialPassword(config.Password), redis.DialDatabase(config.DB))
-			},
-			MaxActive:   config.MaxActive,
-			MaxIdle:     config.MaxIdle,
-			IdleTimeout: config.IdleTimeout,
-			Wait:        config.Wait,
-		},
+	switch {
+	case len(config.Shards) > 0:
+		shards := make([]connPool, len(config.Shards))
+		names := make([]string, len(config.Shards))
+		for i, shard := range config.Shards {
+			shards[i] = newPool(config, shard)
+			names[i] = shardName(shard)
+		}
+		layer.client = shards
+		layer.pool = newShardPool(shards, names)
+		// pub/sub 只使用第一个分片
+		layer.dial = shards[0].(*redis.Pool).Dial
+		layer.hashTags = true
+	case len(config.ClusterAddrs) > 0:
+		cluster := newClusterPool(config.ClusterAddrs, func(addr string) *redis.Pool {
+			// Redis Cluster 只有 0 号数据库
+			node := *config
+			node.Addr, node.DB, node.SentinelAddrs = addr, 0, nil
+			return newPool(config, &node)
+		})
+		layer.client = []connPool{cluster}
+		layer.pool = cluster
+		layer.dial = cluster.dial
+		layer.hashTags = true
+	default:
+		pool := newPool(config, config)
+		layer.client = []connPool{pool}
+		layer.pool = pool
+		layer.dial = pool.Dial
 	}
+}
 
+// newPool 连接池的参数使用 config, 连接的地址使用 target, 配置了 sentinel 时跟随故障转移
+func newPool(config, target *config.RedisConfig) *redis.Pool {
+	pool := &redis.Pool{
+		MaxActive:   config.MaxActive,
+		MaxIdle:     config.MaxIdle,
+		IdleTimeout: config.IdleTimeout,
+		Wait:        config.Wait,
+	}
+	if len(target.SentinelAddrs) > 0 {
+		sentinel := newSentinel(target)
+		pool.Dial = sentinel.dial
+		pool.TestOnBorrow = sentinel.testOnBorrow
+	} else {
+		pool.Dial = func() (redis.Conn, error) {
+			return redis.Dial("tcp", target.Addr, redis.DialPassword(target.Password), redis.DialDatabase(target.DB))
+		}
+	}
+	return pool
 }
 
-func (Layer) groupKey(group string) string {
-	return "group:" + group
+// shardName 分片在哈希环上的标识, 与分片的顺序无关
+func shardName(c *config.RedisConfig) string {
+	if len(c.SentinelAddrs) > 0 {
+		return c.SentinelMaster + "/" + strconv.Itoa(c.DB)
+	}
+	return c.Addr + "/" + strconv.Itoa(c.DB)
 }
 
-func (layer Layer) getPool() *redis.Pool {
-	return layer.client[0]
+// groupChannels 返回多个 group 中 channel 的并集, Redis Cluster 和分片模式下 group 可能不在同一个 slot 或分片, 在客户端合并
+func (layer Layer) groupChannels(client redis.Conn, keys []interface{}) ([]string, error) {
+	if len(keys) == 1 {
+		return redis.Strings(client.Do("SMEMBERS", keys[0]))
+	}
+	if !layer.hashTags {
+		return redis.Strings(client.Do("SUNION", keys...))
+	}
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, key := range keys {
+		channels, err := redis.Strings(client.Do("SMEMBERS", key))
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			if !seen[channel] {
+				seen[channel] = true
+				result = append(result, channel)
+			}
+		}
+	}
+	return result, nil
+}
+
+// tag Redis Cluster 和分片模式下给 key 加上 hash tag, 同一个 group 或节点的 key 落在同一个 slot 或分片
+func (layer Layer) tag(name string) string {
+	if layer.hashTags {
+		return "{" + name + "}"
+	}
+	return name
+}
+
+func (layer Layer) groupKey(group string) string {
+	return "group:" + layer.tag(group)
+}
+
+func (Layer) userKey(user string) string {
+	return "user:" + user
+}
+
+// inboxKey list transport 中节点的收件箱
+func (layer Layer) inboxKey(node string) string {
+	return layer.tag(node)
+}
+
+func (layer Layer) getPool() connPool {
+	return layer.pool
 }
 
 func (layer Layer) Send(message common.Message, channels ...string) error {
@@ -128,22 +325,22 @@ func (layer Layer) Send(message common.Message, channels ...string) error {
 			Message:  message,
 			Channels: []string{channel},
 		}
-		layer.sendToRedis(nil, noneLocalName, d)
+		if err := layer.sendToRedis(nil, noneLocalName, d); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (layer Layer) userKeysMessageToMap(channelMap []string, message common.Message) map[string]*common.ReceiverLayerMessage {
-	result := make(map[string]*common.ReceiverLayerMessage)
-	for _, channel := range channelMap {
+// channelsToNodes 返回这些 channel 所在的节点, group 消息每个节点只需要投递一次
+func (layer Layer) channelsToNodes(channels []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, channel := range channels {
 		noneLocalName := layer.noneLocalName(channel)
-		if _, ok := result[noneLocalName]; ok {
-			result[noneLocalName].Channels = append(result[noneLocalName].Channels, channel)
-		} else {
-			result[noneLocalName] = &common.ReceiverLayerMessage{
-				Message:  message,
-				Channels: []string{channel},
-			}
+		if !seen[noneLocalName] {
+			seen[noneLocalName] = true
+			result = append(result, noneLocalName)
 		}
 	}
 	return result
@@ -157,13 +354,15 @@ func (layer Layer) noneLocalName(channel string) string {
 	}
 }
 
+func (layer Layer) isLocal(channel string) bool {
+	return layer.noneLocalName(channel) == layer.clientPrefix
+}
+
 func (layer *Layer) receiverTask(ctx context.Context) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("receiver stop:", string(debug.Stack()))
-			fmt.Println("重新启动")
-			time.Sleep(10 * time.Second)
-			go layer.receiverTask(ctx)
+			layer.Logger.Error("receiver task panic, restarting", "node", layer.clientPrefix, "panic", r, "stack", string(debug.Stack()))
+			layer.restartTask(ctx, "receiver", func() { layer.receiverTask(ctx) })
 		}
 	}()
 
@@ -174,44 +373,72 @@ func (layer *Layer) receiverTask(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		default:
-			rawData, err := client.Do("BRPOP", layer.clientPrefix, 5)
+			rawData, err := client.Do("BRPOP", layer.inboxKey(layer.clientPrefix), 5)
+			if err != nil {
+				layer.Logger.Warn("inbox receive failed", "node", layer.clientPrefix, "error", err)
+				if client.Err() != nil {
+					client.Close()
+					client = layer.getPool().Get()
+				}
+				// 避免 redis 不可用时空转
+				select {
+				case <-ctx.Done():
+				case <-time.After(receiverRetryInterval):
+				}
+				continue
+			}
 			if rawData == nil {
 				continue
 			}
 			data, err := redis.ByteSlices(rawData, err)
 			if err != nil {
+				layer.Logger.Warn("invalid inbox reply", "node", layer.clientPrefix, "error", err)
 				continue
 			}
 			if data != nil {
 				var msg common.ReceiverLayerMessage
-				json.Unmarshal(data[1], &msg)
+				if err := layer.Codec.Unmarshal(data[1], &msg); err != nil {
+					layer.Logger.Warn("invalid layer message", "node", layer.clientPrefix, "codec", layer.Codec.Name(), "error", err)
+					continue
+				}
 				layer.ReceiverMessage <- msg
 			}
 		}
 	}
 }
 
-func (layer Layer) sendToRedis(client redis.Conn, serverKey string, data common.ReceiverLayerMessage) {
+func (layer Layer) sendToRedis(client redis.Conn, serverKey string, data common.ReceiverLayerMessage) error {
+	if serverKey == layer.clientPrefix && !layer.MustSendRemote {
+		layer.ReceiverMessage <- data
+		return nil
+	}
 	if client == nil {
 		client = layer.getPool().Get()
 		defer client.Close()
 	}
-	if serverKey != layer.clientPrefix && !layer.MustSendRemote {
-		layer.ReceiverMessage <- data
-	} else {
-		d, _ := json.Marshal(data)
-		client.Do("LPUSH", serverKey, d)
-		client.Do("EXPIRE", serverKey, layer.GroupExpiry)
+	d, err := layer.Codec.Marshal(data)
+	if err != nil {
+		return err
 	}
+	start := time.Now()
+	if err := layer.transport.push(client, serverKey, d); err != nil {
+		layer.Metrics.Add(metrics.RedisSendErrorsTotal, 1)
+		return err
+	}
+	layer.Metrics.Observe(metrics.RedisSendSeconds, time.Since(start).Seconds())
+	return nil
+}
+
+// Sample 更新等待发送的 group 消息数
+func (layer Layer) Sample(collector metrics.Collector) {
+	collector.Set(metrics.LayerSendQueueDepth, float64(len(layer.sendGroupMessage)))
 }
 
 func (layer *Layer) sendTask(ctx context.Context) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("send stop:", string(debug.Stack()))
-			fmt.Println("重新启动")
-			time.Sleep(10 * time.Second)
-			go layer.sendTask(ctx)
+			layer.Logger.Error("send task panic, restarting", "node", layer.clientPrefix, "panic", r, "stack", string(debug.Stack()))
+			layer.restartTask(ctx, "send", func() { layer.sendTask(ctx) })
 		}
 	}()
 
@@ -224,20 +451,52 @@ func (layer *Layer) sendTask(ctx context.Context) {
 			var err error
 			groups := data.Groups
 			message := data.Message
+			var seq []uint64
+			if layer.historyEnabled() && message.MessageType != common.CommandMessageType {
+				seq = make([]uint64, len(groups))
+				for i, group := range groups {
+					if seq[i], err = layer.pushHistory(client, group, message); err != nil {
+						layer.Logger.Warn("group history failed", "group", group, "error", err)
+					}
+				}
+			}
 			keys := make([]interface{}, len(groups))
 			for i := range groups {
 				keys[i] = layer.groupKey(groups[i])
 			}
-			if len(keys) == 1 {
-				channelMap, err = redis.Strings(client.Do("SMEMBERS", keys[0]))
-			} else {
-				channelMap, err = redis.Strings(client.Do("SUNION", keys...))
+			if publisher, ok := layer.transport.(groupPublisher); ok && len(groups) == 1 {
+				d, err := layer.Codec.Marshal(common.ReceiverLayerMessage{
+					Message: message,
+					Groups:  groups,
+					Seq:     seq,
+				})
+				if err == nil {
+					start := time.Now()
+					if err = publisher.publishGroup(client, groups[0], d); err != nil {
+						layer.Metrics.Add(metrics.RedisSendErrorsTotal, 1)
+					} else {
+						layer.Metrics.Observe(metrics.RedisSendSeconds, time.Since(start).Seconds())
+					}
+				}
+				if err != nil {
+					layer.Logger.Warn("group send failed", "group", groups[0], "error", err)
+				}
+				continue
 			}
+			channelMap, err = layer.groupChannels(client, keys)
 			if err != nil {
+				layer.Logger.Warn("group channels failed", "groups", strings.Join(groups, ","), "error", err)
 				continue
 			}
-			for serverKey, data := range layer.userKeysMessageToMap(channelMap, message) {
-				layer.sendToRedis(client, serverKey, *data)
+			d := common.ReceiverLayerMessage{
+				Message: message,
+				Groups:  groups,
+				Seq:     seq,
+			}
+			for _, serverKey := range layer.channelsToNodes(channelMap) {
+				if err := layer.sendToRedis(client, serverKey, d); err != nil {
+					layer.Logger.Warn("group send failed", "groups", strings.Join(groups, ","), "node", serverKey, "error", err)
+				}
 			}
 		case <-ctx.Done():
 			return
@@ -253,9 +512,28 @@ func NewLayer(receiverMessage chan common.ReceiverLayerMessage, c *config.RedisC
 		client:           nil,
 		clientPrefix:     common.RandomString(8),
 		sendGroupMessage: make(chan sendLayerGroupMessage, 500),
+		tasks:            new(sync.WaitGroup),
 		ReceiverMessage:  receiverMessage,
+		Codec:            common.JSONCodec,
+		NodeLease:        DefaultNodeLease,
+		Metrics:          metrics.Discard,
+		Logger:           logger.Default,
+	}
+	if c.NodeName != "" {
+		layer.clientPrefix = c.NodeName
+	}
+	if c.NodeLease > 0 {
+		layer.NodeLease = c.NodeLease
 	}
 	layer.newClient(c)
+	switch c.Transport {
+	case config.RedisPubSubTransport:
+		layer.transport = newPubSubTransport(layer)
+	case config.RedisStreamTransport:
+		layer.transport = streamTransport{layer: layer, maxLen: c.StreamMaxLen}
+	default:
+		layer.transport = listTransport{layer: layer}
+	}
 
 	return layer
 }
@@ -0,0 +1,159 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+// connPool Layer 获取连接的方式, 单机和 sentinel 使用 redis.Pool, Redis Cluster 使用 clusterPool, 分片模式使用 shardPool
+type connPool interface {
+	Get() redis.Conn
+}
+
+// router 按 key 把命令发给对应的 redis, Redis Cluster 和分片模式使用
+type router interface {
+	do(command routedCommand) (interface{}, error)
+	// transaction 在同一个连接上执行 MULTI ... EXEC
+	transaction(commands []routedCommand) (interface{}, error)
+}
+
+type routedCommand struct {
+	name string
+	args []interface{}
+}
+
+// routedConn 实现 redis.Conn, 每条命令由 router 按 key 路由; Send 的命令在下一次 Do、Flush 或 Close 时依次执行,
+// MULTI 到 EXEC 之间的命令在同一个连接上执行, 事务中的 key 必须在同一个 slot
+type routedConn struct {
+	router  router
+	pending []routedCommand
+	closed  bool
+}
+
+func (c *routedConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	_, err := c.Do("")
+	c.closed = true
+	return err
+}
+
+func (c *routedConn) Err() error {
+	if c.closed {
+		return errors.New("redis: connection closed")
+	}
+	return nil
+}
+
+func (c *routedConn) Send(commandName string, args ...interface{}) error {
+	c.pending = append(c.pending, routedCommand{name: commandName, args: args})
+	return nil
+}
+
+func (c *routedConn) Flush() error {
+	_, err := c.Do("")
+	return err
+}
+
+func (c *routedConn) Receive() (interface{}, error) {
+	return nil, errors.New("redis: Receive is not supported")
+}
+
+// Do 与 redigo 的语义一致: 返回最后一条命令的结果和第一个 redis 错误
+func (c *routedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if c.closed {
+		return nil, c.Err()
+	}
+	commands := c.pending
+	c.pending = nil
+	if commandName != "" {
+		commands = append(commands, routedCommand{name: commandName, args: args})
+	}
+
+	var reply interface{}
+	var firstErr error
+	for i := 0; i < len(commands); i++ {
+		var err error
+		if strings.EqualFold(commands[i].name, "MULTI") {
+			end := i + 1
+			for end < len(commands) && !strings.EqualFold(commands[end].name, "EXEC") {
+				end++
+			}
+			if end == len(commands) {
+				return nil, errors.New("redis: MULTI without EXEC")
+			}
+			reply, err = c.router.transaction(commands[i : end+1])
+			i = end
+		} else {
+			reply, err = c.router.do(commands[i])
+		}
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if commandName == "" {
+		return nil, firstErr
+	}
+	return reply, firstErr
+}
+
+// commandKey 返回命令用于路由的 key, 只处理 Layer 用到的命令
+func commandKey(name string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(name) {
+	case "", "MULTI", "EXEC", "DISCARD", "PING", "ASKING", "CLUSTER", "PUBLISH":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) >= 3 {
+			if n, err := strconv.Atoi(argString(args[1])); err == nil && n > 0 {
+				return argString(args[2]), true
+			}
+		}
+		return "", false
+	case "XREAD", "XREADGROUP":
+		for i, arg := range args {
+			if strings.EqualFold(argString(arg), "STREAMS") && i+1 < len(args) {
+				return argString(args[i+1]), true
+			}
+		}
+		return "", false
+	case "XGROUP":
+		if len(args) >= 2 {
+			return argString(args[1]), true
+		}
+		return "", false
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return argString(args[0]), true
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// hashTag 返回 key 中 {} 之间的部分, 没有 hash tag 时返回整个 key
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start > -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"sync"
+	"time"
+	"ws-channels/config"
+)
+
+const (
+	sentinelTimeout   = time.Second
+	sentinelRoleCheck = time.Second
+)
+
+var errSentinelUnavailable = errors.New("redis sentinel: no reachable sentinel")
+
+// sentinel 每次建立连接时向 sentinel 查询当前的主节点, 故障转移后新连接自动连到新的主节点
+type sentinel struct {
+	master   string
+	password string
+	config   *config.RedisConfig
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newSentinel(c *config.RedisConfig) *sentinel {
+	return &sentinel{
+		master:   c.SentinelMaster,
+		password: c.SentinelPassword,
+		config:   c,
+		addrs:    append([]string{}, c.SentinelAddrs...),
+	}
+}
+
+// masterAddr 依次询问 sentinel, 回答成功的 sentinel 移到最前面
+func (s *sentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string{}, s.addrs...)
+	s.mu.Unlock()
+
+	err := errSentinelUnavailable
+	for i, addr := range addrs {
+		var master string
+		if master, err = s.queryMaster(addr); err != nil {
+			continue
+		}
+		if i > 0 {
+			s.mu.Lock()
+			for j, current := range s.addrs {
+				if current == addr {
+					copy(s.addrs[1:j+1], s.addrs[:j])
+					s.addrs[0] = addr
+					break
+				}
+			}
+			s.mu.Unlock()
+		}
+		return master, nil
+	}
+	return "", err
+}
+
+func (s *sentinel) queryMaster(addr string) (string, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(sentinelTimeout),
+		redis.DialReadTimeout(sentinelTimeout),
+		redis.DialWriteTimeout(sentinelTimeout),
+	}
+	if s.password != "" {
+		options = append(options, redis.DialPassword(s.password))
+	}
+	conn, err := redis.Dial("tcp", addr, options...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", errors.New("redis sentinel: unknown master " + s.master)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+func (s *sentinel) dial() (redis.Conn, error) {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	return redis.Dial("tcp", addr, redis.DialPassword(s.config.Password), redis.DialDatabase(s.config.DB))
+}
+
+// testOnBorrow 空闲超过一秒的连接确认仍然连着主节点, 故障转移后旧主节点变为从节点时丢弃连接;
+// 不支持 ROLE 命令的服务端视为主节点
+func (s *sentinel) testOnBorrow(conn redis.Conn, t time.Time) error {
+	if time.Since(t) < sentinelRoleCheck {
+		return nil
+	}
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if _, ok := err.(redis.Error); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("redis sentinel: empty ROLE reply")
+	}
+	if role, _ := redis.String(reply[0], nil); role != "master" {
+		return errors.New("redis sentinel: connected to " + role)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// shardReplicas 每个分片在哈希环上的虚拟节点数
+const shardReplicas = 128
+
+type shardPoint struct {
+	hash  uint32
+	shard int
+}
+
+// shardPool 用一致性哈希把 key 分布到多个独立的 redis 上, 有 hash tag 时只使用 {} 中的部分,
+// 同一个 group 或节点的 key 落在同一个分片; 没有 key 的命令 (PUBLISH 等) 发给第一个分片,
+// 所以第一个分片和 nodes 所在的分片是单点, 见 config.RedisConfig.Shards
+type shardPool struct {
+	shards []connPool
+	ring   []shardPoint
+}
+
+// newShardPool names 是每个分片的标识, 增减分片时其他分片的标识不变, 只有少量 key 需要迁移
+func newShardPool(shards []connPool, names []string) *shardPool {
+	s := &shardPool{shards: shards}
+	for i, name := range names {
+		for j := 0; j < shardReplicas; j++ {
+			s.ring = append(s.ring, shardPoint{
+				hash:  crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(j))),
+				shard: i,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return s
+}
+
+func (s *shardPool) Get() redis.Conn {
+	return &routedConn{router: s}
+}
+
+// shard 返回 key 所在的分片
+func (s *shardPool) shard(key string, hasKey bool) int {
+	if !hasKey || len(s.ring) == 0 {
+		return 0
+	}
+	hash := crc32.ChecksumIEEE([]byte(hashTag(key)))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= hash })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+func (s *shardPool) do(command routedCommand) (interface{}, error) {
+	conn := s.shards[s.shard(commandKey(command.name, command.args))].Get()
+	defer conn.Close()
+	return conn.Do(command.name, command.args...)
+}
+
+// transaction 按事务中第一个 key 路由, 事务中的 key 必须使用相同的 hash tag
+func (s *shardPool) transaction(commands []routedCommand) (interface{}, error) {
+	key, hasKey := "", false
+	for _, command := range commands {
+		if key, hasKey = commandKey(command.name, command.args); hasKey {
+			break
+		}
+	}
+	conn := s.shards[s.shard(key, hasKey)].Get()
+	defer conn.Close()
+	for _, command := range commands {
+		_ = conn.Send(command.name, command.args...)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	var err error
+	for range commands {
+		var e error
+		if reply, e = conn.Receive(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return reply, err
+}
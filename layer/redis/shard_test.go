@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"testing"
+	"ws-channels/common"
+	"ws-channels/config"
+)
+
+// shardConfig 用同一个 redis 的 1、2、3 号数据库作为三个分片
+func shardConfig(t *testing.T) *config.RedisConfig {
+	c := redisConfig(t)
+	for db := 1; db <= 3; db++ {
+		c.Shards = append(c.Shards, &config.RedisConfig{Addr: c.Addr, DB: db})
+	}
+	return c
+}
+
+func TestShardPool(t *testing.T) {
+	names := []string{"a:6379/0", "b:6379/0", "c:6379/0"}
+	shards := newShardPool(make([]connPool, len(names)), names)
+	if shards.shard("group:{foo}", true) != shards.shard("history:{foo}", true) {
+		t.Error("keys with the same hash tag should be on the same shard")
+	}
+	if shards.shard("", false) != 0 {
+		t.Error("keyless commands should go to the first shard")
+	}
+
+	counts := make([]int, len(names))
+	for i := 0; i < 3000; i++ {
+		counts[shards.shard("group:{"+strconv.Itoa(i)+"}", true)]++
+	}
+	for i, count := range counts {
+		if count < 500 {
+			t.Errorf("shard %d: got %d of 3000 keys", i, count)
+		}
+	}
+
+	// 增加一个分片后只有新分片上的 key 移动
+	more := newShardPool(make([]connPool, len(names)+1), append(names, "d:6379/0"))
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := "group:{" + strconv.Itoa(i) + "}"
+		if before, after := shards.shard(key, true), more.shard(key, true); before != after {
+			if after != len(names) {
+				t.Fatalf("%s: moved from shard %d to %d", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Errorf("moved %d of 3000 keys", moved)
+	}
+}
+
+func TestShardLayerSuite(t *testing.T) {
+	c := shardConfig(t)
+	redisSuite(c, nil).Run(t)
+}
+
+func TestShardGroups(t *testing.T) {
+	c := shardConfig(t)
+	layer := NewLayer(make(chan common.ReceiverLayerMessage, 10), c)
+	channel := layer.NewChannel("")
+	groups := make([]string, 30)
+	for i := range groups {
+		groups[i] = "shard-" + common.RandomString(8)
+	}
+	if err := layer.GroupAdd(channel, groups...); err != nil {
+		t.Fatal(err)
+	}
+	defer layer.GroupDiscard(channel, groups...)
+
+	// group 分布在多个分片上
+	used := 0
+	for _, shard := range layer.client {
+		conn := shard.Get()
+		found := false
+		for _, group := range groups {
+			if exists, _ := redis.Bool(conn.Do("EXISTS", layer.groupKey(group))); exists {
+				found = true
+			}
+		}
+		conn.Close()
+		if found {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("groups on %d shard(s)", used)
+	}
+
+	client := layer.getPool().Get()
+	defer client.Close()
+	keys := make([]interface{}, len(groups))
+	for i, group := range groups {
+		keys[i] = layer.groupKey(group)
+	}
+	channels, err := layer.groupChannels(client, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0] != channel {
+		t.Errorf("union across shards: got %v", channels)
+	}
+}
@@ -0,0 +1,214 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"runtime/debug"
+	"strings"
+	"time"
+	"ws-channels/common"
+)
+
+const (
+	streamGroup     = "ws-channels"
+	streamField     = "message"
+	streamReadCount = 100
+	streamBlock     = 5000 // 毫秒
+)
+
+var errInvalidStreamEntry = errors.New("redis: stream entry without " + streamField + " field")
+
+// streamTransport 每个节点一个 stream, 通过消费组读取, 消息交给客户端后才 XACK,
+// 节点用相同的 NodeName 重启后会重新投递上次未确认的消息; 租约过期被清理时保留 stream, 直到 GroupExpiry 过期
+type streamTransport struct {
+	layer  *Layer
+	maxLen int64
+}
+
+func (layer Layer) streamKey(node string) string {
+	return "stream:" + layer.tag(node)
+}
+
+func (t streamTransport) push(client redis.Conn, serverKey string, data []byte) error {
+	key := t.layer.streamKey(serverKey)
+	args := []interface{}{key}
+	if t.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", t.maxLen)
+	}
+	args = append(args, "*", streamField, data)
+	if _, err := client.Do("XADD", args...); err != nil {
+		return err
+	}
+	_, err := client.Do("EXPIRE", key, t.layer.GroupExpiry)
+	return err
+}
+
+func (t streamTransport) run(ctx context.Context) {
+	if err := t.createGroup(); err != nil {
+		t.layer.Logger.Warn("stream create group failed", "node", t.layer.clientPrefix, "error", err)
+	}
+	if err := t.reclaim(); err != nil {
+		t.layer.Logger.Warn("stream reclaim failed", "node", t.layer.clientPrefix, "error", err)
+	}
+	for i := 0; i < t.layer.ReceiverTaskNum; i++ {
+		t.layer.goTask(func() { t.receiverTask(ctx) })
+	}
+}
+
+func (t streamTransport) createGroup() error {
+	client := t.layer.getPool().Get()
+	defer client.Close()
+	_, err := client.Do("XGROUP", "CREATE", t.layer.streamKey(t.layer.clientPrefix), streamGroup, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// reclaim 重新投递本节点上次运行时已读取但未确认的消息
+func (t streamTransport) reclaim() error {
+	client := t.layer.getPool().Get()
+	defer client.Close()
+	start := "0"
+	for {
+		reply, err := client.Do("XREADGROUP", "GROUP", streamGroup, t.layer.clientPrefix,
+			"COUNT", streamReadCount, "STREAMS", t.layer.streamKey(t.layer.clientPrefix), start)
+		if err != nil {
+			return err
+		}
+		entries, err := t.parse(reply)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		for _, entry := range entries {
+			t.deliver(entry)
+		}
+		start = entries[len(entries)-1].id
+	}
+}
+
+func (t streamTransport) receiverTask(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.layer.Logger.Error("stream receiver task panic, restarting", "node", t.layer.clientPrefix, "panic", r, "stack", string(debug.Stack()))
+			t.layer.restartTask(ctx, "stream_receiver", func() { t.receiverTask(ctx) })
+		}
+	}()
+
+	client := t.layer.getPool().Get()
+	defer client.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			reply, err := client.Do("XREADGROUP", "GROUP", streamGroup, t.layer.clientPrefix,
+				"COUNT", streamReadCount, "BLOCK", streamBlock, "STREAMS", t.layer.streamKey(t.layer.clientPrefix), ">")
+			if err != nil {
+				t.layer.Logger.Warn("stream receive failed", "node", t.layer.clientPrefix, "error", err)
+				if strings.HasPrefix(err.Error(), "NOGROUP") {
+					// stream 过期或被删除后重新创建消费组
+					if err := t.createGroup(); err != nil {
+						t.layer.Logger.Warn("stream create group failed", "node", t.layer.clientPrefix, "error", err)
+					}
+				}
+				if client.Err() != nil {
+					client.Close()
+					client = t.layer.getPool().Get()
+				}
+				t.retryWait(ctx)
+				continue
+			}
+			entries, err := t.parse(reply)
+			if err != nil {
+				t.layer.Logger.Warn("invalid stream reply", "node", t.layer.clientPrefix, "error", err)
+				t.retryWait(ctx)
+				continue
+			}
+			for _, entry := range entries {
+				t.deliver(entry)
+			}
+		}
+	}
+}
+
+type streamEntry struct {
+	id   string
+	data []byte
+}
+
+// parse 解析 XREADGROUP 的返回值, 只读取了一个 stream
+func (t streamTransport) parse(reply interface{}) ([]streamEntry, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, err
+	}
+	items, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]streamEntry, 0, len(items))
+	for _, item := range items {
+		values, err := redis.Values(item, nil)
+		if err != nil || len(values) != 2 {
+			continue
+		}
+		id, _ := redis.String(values[0], nil)
+		// 已被 MAXLEN 裁剪掉的待确认消息字段为 nil
+		fields, _ := redis.ByteSlices(values[1], nil)
+		entry := streamEntry{id: id}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == streamField {
+				entry.data = fields[i+1]
+			}
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// retryWait 出错后等待 receiverRetryInterval 再重试, 避免 redis 不可用时空转
+func (t streamTransport) retryWait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(receiverRetryInterval):
+	}
+}
+
+func (t streamTransport) deliver(entry streamEntry) {
+	var msg common.ReceiverLayerMessage
+	err := errInvalidStreamEntry
+	if entry.data != nil {
+		err = t.layer.Codec.Unmarshal(entry.data, &msg)
+	}
+	if err != nil {
+		// 无法解码的消息重试也不会成功, 记录后确认掉
+		t.layer.Logger.Warn("invalid stream entry", "node", t.layer.clientPrefix, "id", entry.id, "codec", t.layer.Codec.Name(), "error", err)
+		if err := t.ack(entry.id); err != nil {
+			t.layer.Logger.Warn("stream ack failed", "node", t.layer.clientPrefix, "id", entry.id, "error", err)
+		}
+		return
+	}
+	id := entry.id
+	msg.Ack = func() {
+		if err := t.ack(id); err != nil {
+			t.layer.Logger.Warn("stream ack failed", "node", t.layer.clientPrefix, "id", id, "error", err)
+		}
+	}
+	t.layer.ReceiverMessage <- msg
+}
+
+func (t streamTransport) ack(id string) error {
+	client := t.layer.getPool().Get()
+	defer client.Close()
+	_, err := client.Do("XACK", t.layer.streamKey(t.layer.clientPrefix), streamGroup, id)
+	return err
+}
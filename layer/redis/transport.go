@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+)
+
+// transport 节点之间投递消息的方式
+type transport interface {
+	// push 把编码后的消息投递给节点 serverKey
+	push(client redis.Conn, serverKey string, data []byte) error
+	// run 启动接收消息的任务, ctx 结束后退出
+	run(ctx context.Context)
+}
+
+// groupWatcher 需要知道 channel 加入了哪些 group 的 transport, channel 可以在其他节点上
+type groupWatcher interface {
+	groupAdd(channel string, groups ...string) error
+	groupDiscard(channel string, groups ...string) error
+}
+
+// groupPublisher 可以直接向 group 广播消息的 transport
+type groupPublisher interface {
+	publishGroup(client redis.Conn, group string, data []byte) error
+}
+
+// listTransport 每个节点一个 list, 发送方 LPUSH, 节点通过 BRPOP 接收
+type listTransport struct {
+	layer *Layer
+}
+
+func (t listTransport) push(client redis.Conn, serverKey string, data []byte) error {
+	key := t.layer.inboxKey(serverKey)
+	if _, err := client.Do("LPUSH", key, data); err != nil {
+		return err
+	}
+	_, err := client.Do("EXPIRE", key, t.layer.GroupExpiry)
+	return err
+}
+
+func (t listTransport) run(ctx context.Context) {
+	for i := 0; i < t.layer.ReceiverTaskNum; i++ {
+		t.layer.goTask(func() { t.layer.receiverTask(ctx) })
+	}
+}
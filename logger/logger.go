@@ -0,0 +1,163 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logger 分级的结构化日志, args 依次为 key 和 value, 例如 "channel", channel;
+// 方法与 log/slog 的 *slog.Logger 一致, 可以直接传入 slog.Default()
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Level 日志级别, 取值与 slog.Level 相同
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// Default 未配置日志时使用, 输出 Info 及以上级别到标准错误
+var Default Logger = New(os.Stderr, LevelInfo)
+
+// Discard 丢弃所有日志
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debug(string, ...interface{}) {}
+func (discard) Info(string, ...interface{})  {}
+func (discard) Warn(string, ...interface{})  {}
+func (discard) Error(string, ...interface{}) {}
+
+// textLogger 以 slog.TextHandler 的 key=value 格式输出到标准库的 log.Logger
+type textLogger struct {
+	out   *log.Logger
+	level Level
+	args  []interface{}
+}
+
+// New 输出 level 及以上级别的日志到 w
+func New(w io.Writer, level Level) Logger {
+	return FromStd(log.New(w, "", 0), level)
+}
+
+// FromStd 使用标准库的 log.Logger 输出, 时间由 log.Logger 的 flags 决定, flags 为 0 时加上 time 字段
+func FromStd(out *log.Logger, level Level) Logger {
+	return &textLogger{out: out, level: level}
+}
+
+// With 返回带有固定字段的 Logger, 例如 With(logger, "node", node)
+func With(logger Logger, args ...interface{}) Logger {
+	if len(args) == 0 {
+		return logger
+	}
+	if l, ok := logger.(*textLogger); ok {
+		return &textLogger{out: l.out, level: l.level, args: append(append([]interface{}{}, l.args...), args...)}
+	}
+	return &withLogger{logger: logger, args: args}
+}
+
+type withLogger struct {
+	logger Logger
+	args   []interface{}
+}
+
+func (l *withLogger) join(args []interface{}) []interface{} {
+	return append(append([]interface{}{}, l.args...), args...)
+}
+
+func (l *withLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.join(args)...) }
+func (l *withLogger) Info(msg string, args ...interface{})  { l.logger.Info(msg, l.join(args)...) }
+func (l *withLogger) Warn(msg string, args ...interface{})  { l.logger.Warn(msg, l.join(args)...) }
+func (l *withLogger) Error(msg string, args ...interface{}) { l.logger.Error(msg, l.join(args)...) }
+
+func (l *textLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *textLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *textLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *textLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+func (l *textLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	if l.out.Flags() == 0 {
+		b.WriteString("time=")
+		b.WriteString(time.Now().Format(time.RFC3339Nano))
+		b.WriteByte(' ')
+	}
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(quote(msg))
+	writeArgs(&b, l.args)
+	writeArgs(&b, args)
+	_ = l.out.Output(3, b.String())
+}
+
+// writeArgs 与 slog 一致, 落单的 value 使用 !BADKEY 作为 key
+func writeArgs(b *strings.Builder, args []interface{}) {
+	for i := 0; i < len(args); i++ {
+		key, ok := args[i].(string)
+		if !ok || i+1 == len(args) {
+			key = "!BADKEY"
+		} else {
+			i++
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(quote(formatValue(args[i])))
+	}
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// quote 包含空白、引号或等号的值加上引号
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := With(FromStd(log.New(&buf, "", log.Lmsgprefix), LevelInfo), "node", "n1")
+	logger.Debug("hidden")
+	logger.Info("group send failed", "group", "room 1", "error", errors.New("EOF"), 42)
+
+	expected := `level=INFO msg="group send failed" node=n1 group="room 1" error=EOF !BADKEY=42` + "\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+type recorder struct {
+	lines []string
+}
+
+func (r *recorder) log(level string, msg string, args []interface{}) {
+	parts := []string{level, msg}
+	for _, arg := range args {
+		parts = append(parts, formatValue(arg))
+	}
+	r.lines = append(r.lines, strings.Join(parts, " "))
+}
+
+func (r *recorder) Debug(msg string, args ...interface{}) { r.log("DEBUG", msg, args) }
+func (r *recorder) Info(msg string, args ...interface{})  { r.log("INFO", msg, args) }
+func (r *recorder) Warn(msg string, args ...interface{})  { r.log("WARN", msg, args) }
+func (r *recorder) Error(msg string, args ...interface{}) { r.log("ERROR", msg, args) }
+
+// TestWith 其他实现 (例如 *slog.Logger) 通过 With 包装后字段放在前面
+func TestWith(t *testing.T) {
+	r := &recorder{}
+	With(With(r, "node", "n1"), "channel", "c1").Warn("dropped", "group", "g")
+	if len(r.lines) != 1 || r.lines[0] != "WARN dropped node n1 channel c1 group g" {
+		t.Errorf("got %v", r.lines)
+	}
+}
@@ -0,0 +1,77 @@
+package metrics
+
+// Collector 收集指标, 可以替换为其他监控系统的实现; labels 依次为 key 和 value
+type Collector interface {
+	// Add 计数器增加 value
+	Add(name string, value float64, labels ...string)
+	// Set 设置仪表盘的当前值
+	Set(name string, value float64, labels ...string)
+	// Observe 记录一次观测值, 例如耗时的秒数
+	Observe(name string, value float64, labels ...string)
+}
+
+// Sampler 导出之前调用, 用来更新需要采样的仪表盘, 例如队列长度
+type Sampler interface {
+	Sample(collector Collector)
+}
+
+// Discard 丢弃所有指标
+var Discard Collector = discard{}
+
+type discard struct{}
+
+func (discard) Add(string, float64, ...string)     {}
+func (discard) Set(string, float64, ...string)     {}
+func (discard) Observe(string, float64, ...string) {}
+
+// 内置的指标名称
+const (
+	// Connections 当前连接数
+	Connections = "ws_connections"
+	// ConnectionsTotal 建立的连接总数
+	ConnectionsTotal = "ws_connections_total"
+	// DisconnectionsTotal 断开的连接总数
+	DisconnectionsTotal = "ws_disconnections_total"
+	// MessagesReceivedTotal 从客户端收到的消息数
+	MessagesReceivedTotal = "ws_messages_received_total"
+	// MessagesSentTotal 写给客户端的消息数
+	MessagesSentTotal = "ws_messages_sent_total"
+	// MessagesDroppedTotal 发送队列已满丢弃的消息数
+	MessagesDroppedTotal = "ws_messages_dropped_total"
+	// SendQueueDepth 所有客户端发送队列中的消息数, SendQueueMaxDepth 其中最长的队列
+	SendQueueDepth    = "ws_send_queue_depth"
+	SendQueueMaxDepth = "ws_send_queue_max_depth"
+	// LayerMessagesTotal 从 layer 收到的消息数
+	LayerMessagesTotal = "ws_layer_messages_total"
+	// LayerQueueDepth 等待分发的 layer 消息数
+	LayerQueueDepth = "ws_layer_queue_depth"
+	// LayerSendQueueDepth 等待发送的 group 消息数
+	LayerSendQueueDepth = "ws_layer_send_queue_depth"
+	// RedisSendSeconds 节点之间投递一条消息的 redis 耗时, 包括 pub/sub 直接发布到 group 的消息
+	RedisSendSeconds = "ws_redis_send_seconds"
+	// RedisSendErrorsTotal 节点之间投递消息时 redis 出错的次数
+	RedisSendErrorsTotal = "ws_redis_send_errors_total"
+	// TaskRestartsTotal 后台任务 panic 后重新启动的次数
+	TaskRestartsTotal = "ws_task_restarts_total"
+	// RateLimitedTotal 超过限制被拒绝的连接和消息数, limit 标签为 connection、message 或 publish
+	RateLimitedTotal = "ws_rate_limited_total"
+)
+
+// builtinHelp 内置指标在 Registry 中的说明
+var builtinHelp = map[string]string{
+	Connections:           "Current number of websocket connections.",
+	ConnectionsTotal:      "Total number of accepted websocket connections.",
+	DisconnectionsTotal:   "Total number of closed websocket connections.",
+	MessagesReceivedTotal: "Total number of messages received from clients.",
+	MessagesSentTotal:     "Total number of messages written to clients.",
+	MessagesDroppedTotal:  "Total number of messages dropped because a send queue was full.",
+	SendQueueDepth:        "Number of messages waiting in all client send queues.",
+	SendQueueMaxDepth:     "Length of the longest client send queue.",
+	LayerMessagesTotal:    "Total number of messages received from the layer.",
+	LayerQueueDepth:       "Number of layer messages waiting to be dispatched.",
+	LayerSendQueueDepth:   "Number of group messages waiting to be sent by the layer.",
+	RedisSendSeconds:      "Redis round-trip time of delivering a message to a node or publishing it to a group.",
+	RedisSendErrorsTotal:  "Total number of failed redis deliveries to a node or group.",
+	TaskRestartsTotal:     "Total number of background tasks restarted after a panic.",
+	RateLimitedTotal:      "Total number of connections and messages rejected by rate limits.",
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets Observe 默认使用的直方图区间, 单位为秒
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+type series struct {
+	labels string
+	value  float64
+	// buckets 创建直方图序列时 Registry.Buckets 的副本, 之后修改 Buckets 不影响已有的序列
+	buckets []float64
+	counts  []uint64
+	sum     float64
+}
+
+type family struct {
+	kind   string
+	series map[string]*series
+}
+
+// Registry 保存在内存中的 Collector, 作为 http.Handler 以 Prometheus 文本格式导出;
+// 同一个名称第一次使用时决定指标的类型, 之后以其他类型使用会被忽略
+type Registry struct {
+	// Buckets Observe 使用的直方图区间, 只对之后新建的序列生效
+	Buckets []float64
+
+	mu       sync.Mutex
+	families map[string]*family
+	help     map[string]string
+	samplers []Sampler
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{
+		Buckets:  DefaultBuckets,
+		families: make(map[string]*family),
+		help:     make(map[string]string),
+	}
+	for name, help := range builtinHelp {
+		r.help[name] = help
+	}
+	return r
+}
+
+// Register 每次导出之前调用 sampler
+func (r *Registry) Register(sampler Sampler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samplers = append(r.samplers, sampler)
+}
+
+// Help 设置指标的说明
+func (r *Registry) Help(name string, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.help[name] = help
+}
+
+func (r *Registry) Add(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.series(name, counterType, labels); s != nil {
+		s.value += value
+	}
+}
+
+func (r *Registry) Set(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.series(name, gaugeType, labels); s != nil {
+		s.value = value
+	}
+}
+
+func (r *Registry) Observe(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.series(name, histogramType, labels)
+	if s == nil {
+		return
+	}
+	if s.counts == nil {
+		s.buckets = append([]float64(nil), r.Buckets...)
+		s.counts = make([]uint64, len(s.buckets)+1)
+	}
+	i := sort.SearchFloat64s(s.buckets, value)
+	s.counts[i]++
+	s.sum += value
+}
+
+// series 返回名称和标签对应的序列, 类型与已有的指标不一致时返回 nil
+func (r *Registry) series(name string, kind string, labels []string) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{kind: kind, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+	if f.kind != kind {
+		return nil
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		f.series[key] = s
+	}
+	return s
+}
+
+// formatLabels 生成 {k="v",...}, 没有标签时为空字符串
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelReplacer.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// withLabel 在已有的标签后面追加一个标签
+func withLabel(labels string, name string, value string) string {
+	label := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ServeHTTP 以 Prometheus 文本格式 (version 0.0.4) 输出所有指标
+func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	samplers := append([]Sampler{}, r.samplers...)
+	r.mu.Unlock()
+	for _, sampler := range samplers {
+		sampler.Sample(r)
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(resp)
+	r.write(w)
+	_ = w.Flush()
+}
+
+func (r *Registry) write(w *bufio.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.families[name]
+		if help, ok := r.help[name]; ok {
+			w.WriteString("# HELP " + name + " " + strings.Replace(help, "\n", `\n`, -1) + "\n")
+		}
+		w.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != histogramType {
+				w.WriteString(name + s.labels + " " + formatValue(s.value) + "\n")
+				continue
+			}
+			var count uint64
+			for i, bucket := range s.buckets {
+				count += s.counts[i]
+				w.WriteString(name + "_bucket" + withLabel(s.labels, "le", formatValue(bucket)) + " " + strconv.FormatUint(count, 10) + "\n")
+			}
+			count += s.counts[len(s.buckets)]
+			w.WriteString(name + "_bucket" + withLabel(s.labels, "le", "+Inf") + " " + strconv.FormatUint(count, 10) + "\n")
+			w.WriteString(name + "_sum" + s.labels + " " + formatValue(s.sum) + "\n")
+			w.WriteString(name + "_count" + s.labels + " " + strconv.FormatUint(count, 10) + "\n")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type queueSampler struct{ depth int }
+
+func (s *queueSampler) Sample(collector Collector) {
+	collector.Set("queue_depth", float64(s.depth))
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	registry.Buckets = []float64{0.1, 1}
+	registry.Help("requests_total", "Requests.")
+	registry.Register(&queueSampler{depth: 3})
+
+	registry.Add("requests_total", 1, "code", "200")
+	registry.Add("requests_total", 2, "code", "200")
+	registry.Add("requests_total", 1, "code", `a"b`)
+	// 类型不一致的使用被忽略
+	registry.Set("requests_total", 10)
+	registry.Observe("latency_seconds", 0.05)
+	registry.Observe("latency_seconds", 0.5)
+	registry.Observe("latency_seconds", 5)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("content type: %q", contentType)
+	}
+	expected := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# TYPE queue_depth gauge
+queue_depth 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="a\"b"} 1
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", body, expected)
+	}
+}
+
+// TestRegistryBucketsChanged 已有序列继续使用创建时的区间
+func TestRegistryBucketsChanged(t *testing.T) {
+	registry := NewRegistry()
+	registry.Buckets = []float64{1}
+	registry.Observe("latency_seconds", 0.5)
+	registry.Buckets = []float64{0.1, 1, 10}
+	registry.Observe("latency_seconds", 5)
+	registry.Observe("size_bytes", 5)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 5.5
+latency_seconds_count 2
+# TYPE size_bytes histogram
+size_bytes_bucket{le="0.1"} 0
+size_bytes_bucket{le="1"} 0
+size_bytes_bucket{le="10"} 1
+size_bytes_bucket{le="+Inf"} 1
+size_bytes_sum 5
+size_bytes_count 1
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", body, expected)
+	}
+}